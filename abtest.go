@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+// abBuckets is the number of buckets A/B splits assign clients to
+const abBuckets = 100
+
+// abSplit assigns a route's clients to buckets by a hash of a stable
+// identifier and sends each bucket to the variant covering it
+type abSplit struct {
+	key      keyFunc
+	salt     string
+	variants []VariantConfig
+}
+
+func newABSplit(cfg *SplitConfig) (*abSplit, error) {
+	key, err := newKeyFunc(cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	var covered [abBuckets]string
+	for i := range cfg.Variants {
+		v := &cfg.Variants[i]
+		if v.Name == "" {
+			v.Name = v.Pool
+		}
+		first, last := v.Buckets[0], v.Buckets[1]
+		if first < 0 || last >= abBuckets || first > last {
+			return nil, fmt.Errorf("variant %s: buckets must be a range within 0-%d", v.Name, abBuckets-1)
+		}
+		for b := first; b <= last; b++ {
+			if covered[b] != "" {
+				return nil, fmt.Errorf("variants %s and %s share bucket %d", covered[b], v.Name, b)
+			}
+			covered[b] = v.Name
+		}
+	}
+	return &abSplit{key: key, salt: cfg.Salt, variants: cfg.Variants}, nil
+}
+
+// assign returns the request's bucket and the variant covering it, nil if
+// none does, ok is false for requests without the identifier
+func (s *abSplit) assign(r *http.Request) (v *VariantConfig, bucket int, ok bool) {
+	id := s.key(r)
+	if id == "" {
+		return nil, 0, false
+	}
+	h := fnv.New32a()
+	if s.salt != "" {
+		// the separator keeps salt "ab" with id "c" apart from "a" with "bc"
+		h.Write([]byte(s.salt))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(id))
+	bucket = int(h.Sum32() % abBuckets)
+	for i := range s.variants {
+		if v := &s.variants[i]; bucket >= v.Buckets[0] && bucket <= v.Buckets[1] {
+			return v, bucket, true
+		}
+	}
+	return nil, bucket, true
+}
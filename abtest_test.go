@@ -0,0 +1,33 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestABSplitSaltIsSeparated(t *testing.T) {
+	bucket := func(salt, id string) int {
+		split, err := newABSplit(&SplitConfig{Key: "header:X-User", Salt: salt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", id)
+		_, b, ok := split.assign(r)
+		if !ok {
+			t.Fatal("identifier not found")
+		}
+		return b
+	}
+	if bucket("ab", "c") == bucket("a", "bc") {
+		t.Error("salt ab with id c lands in the same bucket as salt a with id bc")
+	}
+	// unsalted splits hash the identifier alone, as they always did
+	h := fnv.New32a()
+	h.Write([]byte("c"))
+	if got, want := bucket("", "c"), int(h.Sum32()%abBuckets); got != want {
+		t.Errorf("unsalted bucket %d, want %d", got, want)
+	}
+}
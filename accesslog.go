@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// accessLogFields maps the access log field names to their values
+var accessLogFields = map[string]func(*RequestRecord) any{
+	"time":       func(r *RequestRecord) any { return r.Time },
+	"method":     func(r *RequestRecord) any { return r.Method },
+	"host":       func(r *RequestRecord) any { return r.Host },
+	"path":       func(r *RequestRecord) any { return r.Path },
+	"route":      func(r *RequestRecord) any { return r.Route },
+	"backend":    func(r *RequestRecord) any { return r.Backend },
+	"status":     func(r *RequestRecord) any { return r.Status },
+	"bytes":      func(r *RequestRecord) any { return r.Bytes },
+	"latency":    func(r *RequestRecord) any { return r.Latency },
+	"client":     func(r *RequestRecord) any { return r.Client },
+	"user_agent": func(r *RequestRecord) any { return r.UserAgent },
+	"request_id": func(r *RequestRecord) any { return r.RequestID },
+	"variant":    func(r *RequestRecord) any { return r.Variant },
+	"bucket":     func(r *RequestRecord) any { return r.Bucket },
+}
+
+// accessLog writes a JSON object with the selected fields for every request
+type accessLog struct {
+	fields []string
+	mu     sync.Mutex
+	enc    *json.Encoder
+}
+
+func newAccessLog(w io.Writer, fields []string) *accessLog {
+	if len(fields) == 0 {
+		fields = slices.Sorted(maps.Keys(accessLogFields))
+	}
+	return &accessLog{fields: fields, enc: json.NewEncoder(w)}
+}
+
+func (l *accessLog) log(rec RequestRecord) {
+	line := make(map[string]any, len(l.fields))
+	for _, f := range l.fields {
+		line[f] = accessLogFields[f](&rec)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(line)
+}
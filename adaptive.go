@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// gradientWindow is the shortest time a sample window spans, each
+	// window also needs gradientWindowSamples responses
+	gradientWindow        = time.Second
+	gradientWindowSamples = 10
+	// gradientLongWindows is how many windows the long term response time
+	// averages over, the first gradientWarmup windows are averaged plainly
+	gradientLongWindows = 600
+	gradientWarmup      = 10
+	// gradientTolerance is how much the response time may grow over its
+	// long term average before the limit is cut
+	gradientTolerance = 1.5
+	// gradientSmoothing is how much of each new estimate goes into the limit
+	gradientSmoothing = 0.2
+)
+
+// gradientLimit discovers the concurrency a backend handles best, the
+// Gradient2 way: every window the average response time is compared to
+// its long term average, while they are close the limit grows by a queue
+// allowance of its square root, when the window is slower the limit
+// shrinks by the ratio of the two, so it settles where adding requests
+// starts queueing them
+type gradientLimit struct {
+	minLimit float64
+	maxLimit float64
+	mu       sync.Mutex
+	limit    float64
+	// longRTT is the long term average response time in seconds over
+	// windows windows
+	longRTT float64
+	windows int
+	// the current window's start, response time total, responses and the
+	// most requests that were in flight
+	start       time.Time
+	sum         float64
+	samples     int
+	maxInFlight int64
+}
+
+func newGradientLimit(cfg *AdaptiveConcurrencyConfig) *gradientLimit {
+	return &gradientLimit{
+		minLimit: float64(cfg.MinLimit),
+		maxLimit: float64(cfg.MaxLimit),
+		limit:    float64(cfg.InitialLimit),
+	}
+}
+
+// current returns the concurrency limit
+func (l *gradientLimit) current() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.limit)
+}
+
+// observe adds the response time of a request sent while inFlight
+// requests were on the backend, itself included, to the window and
+// updates the limit when the window is over
+func (l *gradientLimit) observe(rtt time.Duration, inFlight int64) {
+	if rtt <= 0 {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.samples == 0 {
+		l.start = now
+	}
+	l.sum += rtt.Seconds()
+	l.samples++
+	l.maxInFlight = max(l.maxInFlight, inFlight)
+	if l.samples < gradientWindowSamples || now.Sub(l.start) < gradientWindow {
+		return
+	}
+	short := l.sum / float64(l.samples)
+	maxInFlight := l.maxInFlight
+	l.sum, l.samples, l.maxInFlight = 0, 0, 0
+	l.update(short, maxInFlight)
+}
+
+func (l *gradientLimit) update(short float64, inFlight int64) {
+	l.windows++
+	if l.windows <= gradientWarmup {
+		l.longRTT += (short - l.longRTT) / float64(l.windows)
+	} else {
+		l.longRTT += (short - l.longRTT) * 2 / (gradientLongWindows + 1)
+	}
+	if l.longRTT/short > 2 {
+		// the backend got a lot faster, let the average catch up quicker
+		l.longRTT *= 0.95
+	}
+	if float64(inFlight) < l.limit/2 {
+		// too little traffic to tell whether the limit is right
+		return
+	}
+	gradient := max(0.5, min(1, gradientTolerance*l.longRTT/short))
+	estimate := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = l.limit*(1-gradientSmoothing) + estimate*gradientSmoothing
+	l.limit = max(l.minLimit, min(l.maxLimit, l.limit))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (lb *LoadBalancer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /healthcheck", lb.handleHealthCheck)
+	mux.HandleFunc("GET /stats", lb.handleStats)
+	mux.HandleFunc("GET /metrics", lb.handleMetrics)
+	mux.HandleFunc("GET /version", handleVersion)
+	mux.HandleFunc("GET /selftest", lb.handleSelfTest)
+	mux.HandleFunc("GET /dashboard", lb.handleDashboard)
+	mux.HandleFunc("GET /debug/requests", lb.handleDebugRequests)
+	mux.HandleFunc("POST /backends", lb.handleAddBackend)
+	mux.HandleFunc("DELETE /backends", lb.handleRemoveBackend)
+	mux.HandleFunc("PATCH /backends", lb.handleUpdateBackend)
+	mux.HandleFunc("POST /backends/drain", lb.handleDrainBackend)
+	mux.HandleFunc("POST /backends/breaker", lb.handleForceBreaker)
+	mux.HandleFunc("POST /backends/breaker/reset", lb.handleResetBreaker)
+	mux.HandleFunc("POST /maintenance", lb.handleMaintenance)
+	return mux
+}
+
+func (lb *LoadBalancer) serveAdmin(ln net.Listener) {
+	fmt.Println("admin api started on port:", lb.cfg.AdminPort)
+	if err := http.Serve(ln, lb.adminHandler()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// handleHealthCheck runs a health check right away and reports the results
+func (lb *LoadBalancer) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, lb.HealthCheck(r.Context()))
+}
+
+func (lb *LoadBalancer) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, lb.Stats())
+}
+
+// handleSelfTest sends a request through the load balancer and reports
+// the outcome, failing with 503 so monitors need not parse the body
+func (lb *LoadBalancer) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	res := lb.SelfTest(r.Context())
+	if !res.OK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (lb *LoadBalancer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, lb.Stats())
+}
+
+// handleAddBackend adds the backend the body describes, as a backend in
+// the config would. A duplicate is answered with 409 unless it was merged.
+func (lb *LoadBalancer) handleAddBackend(w http.ResponseWriter, r *http.Request) {
+	var bc BackendConfig
+	if err := json.NewDecoder(r.Body).Decode(&bc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := lb.AddBackend(r.Context(), bc)
+	switch {
+	case errors.Is(err, errDuplicateBackend):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, b.stats())
+}
+
+// handleRemoveBackend removes the backend named by the url query parameter,
+// the timeout parameter bounds the wait for in-flight requests. The backend
+// is out of rotation when the 202 is sent, the wait and the removal go on
+// in the background.
+func (lb *LoadBalancer) handleRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	timeout := 30 * time.Second
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	b, err := lb.takeOutOfRotation(r.URL.Query().Get("url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	go lb.finishRemoval(b, timeout)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// backendUpdate is the body of a backend update, unset fields are left alone
+type backendUpdate struct {
+	Weight *int `json:"weight"`
+}
+
+// handleUpdateBackend changes the backend named by the url query parameter,
+// a weight of 0 takes it out of rotation without removing it
+func (lb *LoadBalancer) handleUpdateBackend(w http.ResponseWriter, r *http.Request) {
+	b := lb.backendByURL(r.URL.Query().Get("url"))
+	if b == nil {
+		http.Error(w, "backend not found", http.StatusNotFound)
+		return
+	}
+	var u backendUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u.Weight != nil {
+		if *u.Weight < 0 {
+			http.Error(w, "negative weight", http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("server %s weight set to %d\n", b.URL, *u.Weight)
+		b.cancelRampDown()
+		b.SetWeight(*u.Weight)
+		lb.rebuildSelectable()
+		if lb.state != nil {
+			lb.state.setWeight(b.URL, *u.Weight)
+		}
+	}
+	writeJSON(w, b.stats())
+}
+
+// handleDrainBackend ramps the weight of the backend named by the url query
+// parameter down to 0 over the duration parameter
+func (lb *LoadBalancer) handleDrainBackend(w http.ResponseWriter, r *http.Request) {
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("duration must be positive")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := lb.DrainGracefully(r.URL.Query().Get("url"), d); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// breakerOf returns the backend named by the url query parameter,
+// answering with an error if there is none or it has no circuit breaker
+func (lb *LoadBalancer) breakerOf(w http.ResponseWriter, r *http.Request) (*Backend, bool) {
+	b := lb.backendByURL(r.URL.Query().Get("url"))
+	if b == nil {
+		http.Error(w, "backend not found", http.StatusNotFound)
+		return nil, false
+	}
+	if b.failFast == nil {
+		http.Error(w, "fail_fast is disabled", http.StatusConflict)
+		return nil, false
+	}
+	return b, true
+}
+
+// handleForceBreaker pins the circuit breaker of the backend named by the
+// url query parameter in the state parameter: open takes the backend out
+// of rotation, closed puts it back in whatever its failures, auto hands
+// the breaker back to the requests
+func (lb *LoadBalancer) handleForceBreaker(w http.ResponseWriter, r *http.Request) {
+	b, ok := lb.breakerOf(w, r)
+	if !ok {
+		return
+	}
+	switch state := r.URL.Query().Get("state"); state {
+	case breakerOpen, breakerClosed:
+		fmt.Printf("server %s circuit breaker forced %s\n", b.URL, state)
+		b.failFast.force(state)
+	case "auto":
+		fmt.Printf("server %s circuit breaker back to automatic\n", b.URL)
+		b.failFast.force("")
+	default:
+		http.Error(w, "state must be open, closed or auto", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, b.stats())
+}
+
+// handleResetBreaker clears the failure counts of the circuit breaker of
+// the backend named by the url query parameter, closing it unless forced
+func (lb *LoadBalancer) handleResetBreaker(w http.ResponseWriter, r *http.Request) {
+	b, ok := lb.breakerOf(w, r)
+	if !ok {
+		return
+	}
+	fmt.Printf("server %s circuit breaker reset\n", b.URL)
+	b.failFast.reset()
+	writeJSON(w, b.stats())
+}
+
+// handleMaintenance turns maintenance mode on or off as the enabled query
+// parameter says
+func (lb *LoadBalancer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if lb.maintenance == nil {
+		http.Error(w, "maintenance page disabled", http.StatusConflict)
+		return
+	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("maintenance mode enabled: %t\n", enabled)
+	lb.maintenance.enabled.Store(enabled)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDebugRequests dumps the request log, oldest request first
+func (lb *LoadBalancer) handleDebugRequests(w http.ResponseWriter, r *http.Request) {
+	if lb.requestLog == nil {
+		http.Error(w, "request log disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, lb.requestLog.snapshot())
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, buildVersion())
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveBackendAnswersBeforeTheDrain(t *testing.T) {
+	lb := newTestLoadBalancer(t, []string{"http://a.example", "http://b.example"}, nil)
+	a := lb.Backends()[0]
+	if !a.acquire() {
+		t.Fatal("backend busy")
+	}
+
+	start := time.Now()
+	r := httptest.NewRequest(http.MethodDelete, "/backends?url=http://a.example&timeout=1m", nil)
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, r)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want 202", rec.Code)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("answered after %s, the drain should go on in the background", d)
+	}
+	if slices.Contains(lb.candidates(""), a) {
+		t.Errorf("backend still in rotation")
+	}
+	if !slices.Contains(lb.Backends(), a) {
+		t.Errorf("backend dropped with a request in flight")
+	}
+
+	a.release()
+	waitFor(t, func() bool { return !slices.Contains(lb.Backends(), a) })
+}
+
+func TestRemoveUnknownBackend(t *testing.T) {
+	lb := newTestLoadBalancer(t, []string{"http://a.example"}, nil)
+	r := httptest.NewRequest(http.MethodDelete, "/backends?url=http://b.example", nil)
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+}
+
+func TestAddBackendDuplicates(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	add := func(lb *LoadBalancer, body string) int {
+		rec := httptest.NewRecorder()
+		lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/backends", strings.NewReader(body)))
+		return rec.Code
+	}
+	// the same backend spelled differently
+	same := strings.Replace(backend.URL, "http://", "HTTP://", 1) + "/api"
+
+	for _, policy := range []string{"reject", "merge"} {
+		lb := newTestLoadBalancer(t, []string{"http://a.example"}, func(cfg *Config) {
+			cfg.DuplicateBackends = policy
+		})
+		if code := add(lb, fmt.Sprintf(`{"url": %q, "weight": 2}`, backend.URL)); code != http.StatusOK {
+			t.Fatalf("%s: adding status %d, want 200", policy, code)
+		}
+		added := lb.Backends()[1]
+		if !slices.Contains(lb.candidates(""), added) {
+			t.Errorf("%s: added backend not in rotation after passing its check", policy)
+		}
+
+		code := add(lb, fmt.Sprintf(`{"url": %q, "weight": 3}`, same))
+		wantCode, wantWeight := http.StatusConflict, 2
+		if policy == "merge" {
+			wantCode, wantWeight = http.StatusOK, 5
+		}
+		if code != wantCode {
+			t.Errorf("%s: duplicate status %d, want %d", policy, code, wantCode)
+		}
+		if n := len(lb.Backends()); n != 2 {
+			t.Errorf("%s: %d backends, want 2", policy, n)
+		}
+		if w := added.Weight(); w != wantWeight {
+			t.Errorf("%s: weight %d, want %d", policy, w, wantWeight)
+		}
+
+		// duplicates in another pool are never merged
+		if code := add(lb, fmt.Sprintf(`{"url": %q, "pool": "other"}`, backend.URL)); code != http.StatusConflict {
+			t.Errorf("%s: duplicate in another pool status %d, want 409", policy, code)
+		}
+	}
+}
+
+func TestAddedBackendIsProbed(t *testing.T) {
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer second.Close()
+	lb := newTestLoadBalancer(t, []string{first.URL}, func(cfg *Config) {
+		cfg.HealthCheckInterval = Duration{10 * time.Millisecond}
+	})
+	lb.Start()
+	// the schedule is made up of the backends there when the loop started
+	time.Sleep(50 * time.Millisecond)
+
+	b, err := lb.AddBackend(t.Context(), BackendConfig{URL: second.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.IsAlive() {
+		t.Fatal("added backend failed its first check")
+	}
+	second.Close()
+	waitFor(t, func() bool { return !b.IsAlive() })
+}
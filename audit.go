@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// distributionAuditor compares how requests were actually spread over each
+// pool's backends with what their weights ask for
+type distributionAuditor struct {
+	cfg *DistributionAuditConfig
+	wrr *weightedRoundRobin
+	// last is each backend's request count at the previous audit
+	last map[*Backend]uint64
+}
+
+func newDistributionAuditor(cfg *DistributionAuditConfig, wrr *weightedRoundRobin) *distributionAuditor {
+	return &distributionAuditor{cfg: cfg, wrr: wrr, last: make(map[*Backend]uint64)}
+}
+
+// auditPeriodically audits the distribution every interval until ctx is done
+func (lb *LoadBalancer) auditPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(lb.auditor.cfg.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lb.auditor.audit(lb.Backends())
+		}
+	}
+}
+
+// audit checks the requests each backend got since the previous audit
+// against its share of its pool's weight, backends that were out of
+// rotation at the time of the audit are left out of both sides
+func (a *distributionAuditor) audit(backends []*Backend) {
+	counts := make(map[*Backend]uint64, len(backends))
+	requests := make(map[string]uint64)
+	weights := make(map[string]int)
+	for _, b := range backends {
+		n := b.requests.Load()
+		last, seen := a.last[b]
+		counts[b] = n - last
+		if !seen || !b.IsAlive() || b.Draining() || b.Weight() <= 0 {
+			// new backends start counting from here
+			delete(counts, b)
+		} else {
+			requests[b.Pool] += counts[b]
+			weights[b.Pool] += b.Weight()
+		}
+	}
+	clear(a.last)
+	for _, b := range backends {
+		a.last[b] = b.requests.Load()
+	}
+
+	for _, b := range backends {
+		n, ok := counts[b]
+		total := requests[b.Pool]
+		if !ok || total == 0 || total < a.cfg.MinRequests {
+			continue
+		}
+		want := float64(b.Weight()) / float64(weights[b.Pool])
+		got := float64(n) / float64(total)
+		if math.Abs(got-want) <= a.cfg.Threshold {
+			if a.cfg.Correct {
+				a.wrr.resetFactor(b)
+			}
+			continue
+		}
+		msg := fmt.Sprintf("distribution drift: server %s got %.1f%% of pool %q requests (%d of %d), its weight %d asks for %.1f%%",
+			b.URL, got*100, b.Pool, n, total, b.Weight(), want*100)
+		if a.cfg.Correct {
+			// the factor comes from this window's drift alone, halfway to
+			// the weight that would have hit the target as going all the
+			// way overshoots when the drift was noise. Compounding it over
+			// windows drifts the factor into its bounds.
+			f := 2.0
+			if got > 0 {
+				f = (1 + want/got) / 2
+			}
+			msg += fmt.Sprintf(", effective weight factor now %.2f", a.wrr.setFactor(b, f))
+		} else {
+			msg += ", check for backends flapping or a selection bug"
+		}
+		fmt.Println(msg)
+	}
+}
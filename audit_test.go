@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditFactorFollowsEachWindow(t *testing.T) {
+	lb := newTestLoadBalancer(t, []string{"http://a.example", "http://b.example"}, func(cfg *Config) {
+		cfg.Strategy = "weighted-round-robin"
+		cfg.DistributionAudit = &DistributionAuditConfig{
+			Interval:  Duration{time.Hour},
+			Threshold: 0.1,
+			Correct:   true,
+		}
+	})
+	a, b := lb.Backends()[0], lb.Backends()[1]
+	wrr := lb.auditor.wrr
+	window := func(na, nb uint64) {
+		a.requests.Add(na)
+		b.requests.Add(nb)
+		lb.auditor.audit(lb.Backends())
+	}
+	window(0, 0)
+
+	// the same drift window after window gives the same factor
+	for range 5 {
+		window(80, 20)
+		if f := wrr.factor[a]; f < 0.8 || f > 0.82 {
+			t.Fatalf("factor %.3f, want (1 + 0.5/0.8) / 2", f)
+		}
+	}
+	window(50, 50)
+	if len(wrr.factor) != 0 {
+		t.Errorf("factors %v kept once the drift is gone", wrr.factor)
+	}
+
+	window(80, 20)
+	if err := lb.RemoveBackendGraceful("http://a.example", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := wrr.factor[a]; ok {
+		t.Errorf("factor kept for a removed backend")
+	}
+}
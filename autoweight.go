@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// autoWeightPeriodically re-derives backend weights every interval until ctx is done
+func (lb *LoadBalancer) autoWeightPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(lb.cfg.AutoWeight.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lb.autoWeight()
+		}
+	}
+}
+
+// autoWeight sets each backend's weight inversely proportional to its
+// average latency, the fastest backend gets the max weight, backends
+// without measurements or set to 0 keep the weight they have
+func (lb *LoadBalancer) autoWeight() {
+	aw := lb.cfg.AutoWeight
+	backends := lb.Backends()
+	var fastest time.Duration
+	for _, b := range backends {
+		if l := b.Latency(); l > 0 && (fastest == 0 || l < fastest) {
+			fastest = l
+		}
+	}
+	if fastest == 0 {
+		return
+	}
+	for _, b := range backends {
+		l := b.Latency()
+		if l == 0 || b.Weight() == 0 {
+			continue
+		}
+		w := int(float64(aw.MaxWeight) * float64(fastest) / float64(l))
+		w = min(max(w, aw.MinWeight), aw.MaxWeight)
+		if w != b.Weight() {
+			fmt.Printf("server %s weight set to %d (latency %s)\n", b.URL, w, l)
+			b.SetWeight(w)
+		}
+	}
+}
+
+// probeWeight scales each healthy backend's weight down as its health probe
+// slows past the slow threshold, from the max weight to the min weight at
+// max latency, backends set to 0 keep their weight
+func (lb *LoadBalancer) probeWeight(backends []*Backend, probes []probeResult) {
+	pw := lb.cfg.ProbeWeight
+	for i, b := range backends {
+		p := probes[i]
+		if p.err != nil || b.Weight() == 0 {
+			continue
+		}
+		w := pw.MaxWeight
+		if p.latency > pw.SlowThreshold.Duration {
+			slow := float64(p.latency-pw.SlowThreshold.Duration) / float64(pw.MaxLatency.Duration-pw.SlowThreshold.Duration)
+			w = pw.MaxWeight - int(min(slow, 1)*float64(pw.MaxWeight-pw.MinWeight))
+		}
+		if w != b.Weight() {
+			fmt.Printf("server %s weight set to %d (probe latency %s)\n", b.URL, w, p.latency)
+			b.SetWeight(w)
+		}
+	}
+}
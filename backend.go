@@ -0,0 +1,520 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend server
+type Backend struct {
+	URL          *url.URL
+	Labels       map[string]string
+	Pool         string
+	Alive        bool
+	ReverseProxy *httputil.ReverseProxy
+	transport    *http.Transport
+	// h2transport carries the gRPC requests translated from gRPC-Web
+	h2transport *http.Transport
+	// MaxConns caps the concurrent requests sent to the backend, 0 is no limit
+	MaxConns    int64
+	activeConns atomic.Int64
+	// activeCost is the estimated cost of the requests in flight, in
+	// thousandths, it stays 0 unless request costs are estimated
+	activeCost atomic.Int64
+	// shaper spaces out the requests sent to the backend, nil if it has no max rate
+	shaper *shaper
+	// adaptive is the concurrency limit learned from response times, nil if disabled
+	adaptive *gradientLimit
+	// failFast limits the requests the backend gets while failing, nil if disabled
+	failFast *failFastBudget
+	// RequestTimeout bounds each request sent to the backend, 0 is no limit
+	RequestTimeout time.Duration
+	// HealthCheckInterval is how often the backend is probed
+	HealthCheckInterval time.Duration
+	// HealthCheckURL is where the backend is probed, nil probes URL
+	HealthCheckURL *url.URL
+	// probeTimeouts bound the connect and read phases of the backend's probes
+	probeTimeouts probeTimeouts
+	// health probes the backend with its pool's settings
+	health *healthChecker
+	load   float64
+	weight int
+	// ramp is the running weight ramp-down, nil if none, see DrainGracefully
+	ramp *rampDown
+	// version is the version the backend last reported to a health probe
+	version string
+	// requests counts the requests sent to the backend, errors the ones that failed
+	requests atomic.Uint64
+	errors   atomic.Uint64
+	// responses counts the backend's responses by status class, 1xx to 5xx
+	responses [5]atomic.Uint64
+	// clientCancels counts the requests whose client left before the response
+	clientCancels atomic.Uint64
+	// windowStart is the request count when the current traffic window
+	// began, only touched by rollTrafficWindow
+	windowStart uint64
+	// windowFailed is the failed request count when the window began and
+	// errorRateHigh whether the last window's error rate was over the
+	// alert threshold, only touched by rollTrafficWindow as well
+	windowFailed  uint64
+	errorRateHigh bool
+	// requestShare is the backend's share of its pool's requests in the last window
+	requestShare float64
+	// latency is the moving average of the backend's response time
+	latency time.Duration
+	// draining backends take no new requests until they pass a health check
+	draining bool
+	// health check details, guarded by mu, probeFailed is whether the
+	// last probe failed even if fail-open kept the backend alive
+	probeFailed    bool
+	probeLatency   time.Duration
+	lastTransition time.Time
+	lastError      string
+	mu             sync.RWMutex
+	// probeMu keeps health checks from probing the backend concurrently
+	probeMu sync.Mutex
+}
+
+// statusClientClosedRequest is logged for requests whose client went away
+// before anything was written to it, as nginx does, it is never sent
+const statusClientClosedRequest = 499
+
+// loadSmoothing is the weight of a new load report in the moving average
+const loadSmoothing = 0.3
+
+// latencySmoothing is the weight of a new response time in the moving average
+const latencySmoothing = 0.2
+
+func (b *Backend) SetAlive(alive bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Alive = alive
+}
+
+// recordProbe stores the outcome of a health probe and the resulting state
+func (b *Backend) recordProbe(alive bool, latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if alive != b.Alive || b.lastTransition.IsZero() {
+		b.lastTransition = time.Now()
+	}
+	b.Alive = alive
+	b.probeFailed = err != nil
+	b.probeLatency = latency
+	if err != nil {
+		b.lastError = err.Error()
+	} else {
+		b.draining = false
+	}
+}
+
+func (b *Backend) IsAlive() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Alive
+}
+
+// Drain stops new requests going to the backend until it passes a health check
+func (b *Backend) Drain() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.draining = true
+}
+
+func (b *Backend) Draining() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.draining
+}
+
+// ReportLoad folds a load value reported by the backend into its smoothed load
+func (b *Backend) ReportLoad(load float64) {
+	load = min(max(load, 0), 1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.load += loadSmoothing * (load - b.load)
+}
+
+// Load returns the smoothed load the backend last reported
+func (b *Backend) Load() float64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.load
+}
+
+// Weight returns the backend's share of traffic for weighted strategies
+func (b *Backend) Weight() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.weight
+}
+
+func (b *Backend) SetWeight(weight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.weight = weight
+}
+
+// versionLabel is the label holding the version a backend reports to its
+// health probes, it takes precedence over a configured label of the name
+const versionLabel = "version"
+
+func (b *Backend) setVersion(version string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if version != b.version {
+		fmt.Printf("server %s reports version %s\n", b.URL, version)
+	}
+	b.version = version
+}
+
+// Label returns the value of the backend's label, empty if it has none
+func (b *Backend) Label(name string) string {
+	if name == versionLabel {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		if b.version != "" {
+			return b.version
+		}
+	}
+	return b.Labels[name]
+}
+
+// hasLabels reports whether the backend carries every one of the labels
+func (b *Backend) hasLabels(labels map[string]string) bool {
+	for name, value := range labels {
+		if b.Label(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// observeLatency folds a response time into the backend's average latency
+func (b *Backend) observeLatency(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.latency == 0 {
+		b.latency = d
+		return
+	}
+	b.latency += time.Duration(latencySmoothing * float64(d-b.latency))
+}
+
+// Latency returns the average response time, 0 if nothing was measured yet
+func (b *Backend) Latency() time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.latency
+}
+
+func (b *Backend) setRequestShare(share float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requestShare = share
+}
+
+// ActiveConns returns the number of requests the backend is serving
+func (b *Backend) ActiveConns() int64 {
+	return b.activeConns.Load()
+}
+
+// Saturated reports whether the backend is serving as many requests as
+// its connection limit allows
+func (b *Backend) Saturated() bool {
+	limit := b.connLimit()
+	return limit > 0 && b.activeConns.Load() >= limit
+}
+
+// connLimit returns the lower of MaxConns and the adaptive limit, 0 if
+// neither is set
+func (b *Backend) connLimit() int64 {
+	limit := b.MaxConns
+	if b.adaptive != nil {
+		if l := b.adaptive.current(); limit == 0 || l < limit {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// Available reports whether the backend can take another request, a weight
+// of 0 keeps the backend known and health checked but out of rotation
+func (b *Backend) Available() bool {
+	return b.IsAlive() && !b.Draining() && b.Weight() > 0 && !b.Saturated() &&
+		(b.failFast == nil || b.failFast.allows())
+}
+
+// acquire reserves a connection slot, it fails if the backend is saturated
+// or failing with its probe budget spent
+func (b *Backend) acquire() bool {
+	limit := b.connLimit()
+	for {
+		n := b.activeConns.Load()
+		if limit > 0 && n >= limit {
+			return false
+		}
+		if b.activeConns.CompareAndSwap(n, n+1) {
+			break
+		}
+	}
+	if b.failFast != nil && !b.failFast.take() {
+		b.activeConns.Add(-1)
+		return false
+	}
+	b.requests.Add(1)
+	return true
+}
+
+// countResponse counts a response from the backend by its status class
+func (b *Backend) countResponse(status int) {
+	if class := status / 100; class >= 1 && class <= len(b.responses) {
+		b.responses[class-1].Add(1)
+	}
+}
+
+// FailingFast reports whether the backend failed enough requests in a row
+// to be limited to its probe budget
+func (b *Backend) FailingFast() bool {
+	return b.failFast != nil && b.failFast.failing()
+}
+
+// recordOutcome feeds a request's outcome to the fail-fast budget
+func (b *Backend) recordOutcome(ok bool) {
+	if b.failFast == nil || !b.failFast.record(ok) {
+		return
+	}
+	if ok {
+		fmt.Printf("server %s recovered, back to full traffic\n", b.URL)
+	} else {
+		fmt.Printf("server %s is failing, limited to probe requests\n", b.URL)
+	}
+}
+
+func (b *Backend) release() {
+	b.activeConns.Add(-1)
+}
+
+func (b *Backend) closeIdleConnections() {
+	b.transport.CloseIdleConnections()
+	b.h2transport.CloseIdleConnections()
+}
+
+func (lb *LoadBalancer) newBackend(bc BackendConfig) (*Backend, error) {
+	u, err := url.Parse(bc.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var healthURL *url.URL
+	if bc.HealthCheckURL != "" {
+		if healthURL, err = url.Parse(bc.HealthCheckURL); err != nil {
+			return nil, err
+		}
+	}
+
+	weight := 1
+	if bc.Weight != nil {
+		if *bc.Weight < 0 {
+			return nil, fmt.Errorf("backend %s: negative weight", bc.URL)
+		}
+		weight = *bc.Weight
+	}
+
+	var poolInterval time.Duration
+	if ph := lb.cfg.PoolHealth[bc.Pool]; ph != nil {
+		poolInterval = ph.Interval.Duration
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		http10Request(r)
+		stripHeaders(r.Header, lb.stripRequestHeaders)
+		lb.forwardClientCert(r)
+		lb.requestUpstreamGzip(r)
+		preserveHeaders(r, lb.cfg.PreserveRequestHeaders)
+	}
+	transport := lb.newTransport(bc)
+	h2transport := newH2Transport(transport)
+	proxy.Transport = restoreHeaders{grpcTransport{next: transport, h2: h2transport}}
+
+	b := &Backend{
+		URL:                 u,
+		Labels:              bc.Labels,
+		Pool:                bc.Pool,
+		MaxConns:            bc.MaxConns,
+		RequestTimeout:      cmp.Or(bc.RequestTimeout.Duration, lb.cfg.RequestTimeout.Duration),
+		HealthCheckInterval: cmp.Or(bc.HealthCheckInterval.Duration, poolInterval, lb.cfg.HealthCheckInterval.Duration),
+		HealthCheckURL:      healthURL,
+		health:              cmp.Or(lb.health[bc.Pool], lb.defaultHealth),
+		weight:              weight,
+		ReverseProxy:        proxy,
+		transport:           transport,
+		h2transport:         h2transport,
+	}
+	b.probeTimeouts = probeTimeouts{
+		connect: cmp.Or(bc.HealthCheckConnectTimeout.Duration, lb.cfg.HealthCheckConnectTimeout.Duration),
+		read:    cmp.Or(bc.HealthCheckReadTimeout.Duration, lb.cfg.HealthCheckReadTimeout.Duration),
+	}
+	if lb.cfg.FailFast != nil {
+		b.failFast = newFailFastBudget(lb.cfg.FailFast)
+	}
+	if bc.MaxRate > 0 {
+		b.shaper = newShaper(bc.MaxRate, cmp.Or(bc.RateQueue, 10), cmp.Or(bc.RateQueueTimeout.Duration, time.Second))
+	}
+	if lb.cfg.AdaptiveConcurrency != nil {
+		b.adaptive = newGradientLimit(lb.cfg.AdaptiveConcurrency)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, errSlowBody) || bodyTooSlow(r.Context()) {
+			// the client's fault, the backend did nothing wrong, the stalled
+			// read may have canceled the request too
+			lb.errorLog.log(b.URL.String(), errSlowBody)
+			lb.setResponseHeaders(w.Header(), r, b)
+			http.Error(w, strings.ToLower(http.StatusText(http.StatusRequestTimeout)), http.StatusRequestTimeout)
+			return
+		}
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			// the client left, that says nothing about the backend and
+			// there is no one to answer
+			b.clientCancels.Add(1)
+			fmt.Printf("%s %s: client went away waiting for server %s\n", r.Method, r.URL.Path, b.URL)
+			return
+		}
+		b.errors.Add(1)
+		b.recordOutcome(false)
+		if a := attemptFrom(r.Context()); a != nil && a.canRetry && retryable(err, r) &&
+			(lb.retryBudget == nil || lb.retryBudget.spend()) {
+			a.err = err
+			return
+		}
+		lb.errorLog.log(b.URL.String(), err)
+		if lb.stale != nil && !lb.standby(b) && lb.stale.serve(w, r) {
+			return
+		}
+		status := errorStatus(err)
+		lb.setResponseHeaders(w.Header(), r, b)
+		http.Error(w, strings.ToLower(http.StatusText(status)), status)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if err := lb.limitResponse(b, resp); err != nil {
+			return err
+		}
+		lb.setResponseHeaders(resp.Header, resp.Request, b)
+		lb.rewriteLocation(resp)
+		b.recordOutcome(resp.StatusCode < 500)
+		b.countResponse(resp.StatusCode)
+		lb.readLoad(b, resp)
+		lb.readDrain(b, resp)
+		grpcWebResponse(resp)
+		if err := gunzipResponse(resp); err != nil {
+			return err
+		}
+		if err := lb.rewriteBody(resp); err != nil {
+			return err
+		}
+		if lb.stale != nil && !lb.standby(b) {
+			lb.stale.handleResponse(resp)
+		}
+		// after the stale cache, the session cookie is this client's own
+		if lb.stickyCookie != nil {
+			lb.stickyCookie.setCookie(b, resp)
+		}
+		return nil
+	}
+	return b, nil
+}
+
+// standby reports whether b is the sorry or the dual write secondary
+// backend, which stand outside the pools and whose answers aren't cached
+func (lb *LoadBalancer) standby(b *Backend) bool {
+	return b == lb.sorry || (lb.dualWrite != nil && b == lb.dualWrite.secondary)
+}
+
+// newTransport creates the transport a backend's requests go out on
+func (lb *LoadBalancer) newTransport(bc BackendConfig) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = newDialer(lb.cfg, 30*time.Second).DialContext
+	if bc.TLSServerName != "" || lb.backendCAs != nil {
+		// a fresh TLS connection to the backend, whatever the client's
+		// connection to the load balancer was, verified against the backend CAs
+		t.TLSClientConfig = &tls.Config{ServerName: bc.TLSServerName, RootCAs: lb.backendCAs}
+	}
+	// with a timeout set the transport forwards Expect: 100-continue and
+	// holds the body back until the backend agrees, only then is the
+	// client body read, which is when the client gets its 100 Continue
+	t.ExpectContinueTimeout = lb.cfg.ExpectContinueTimeout.Duration
+	t.DisableKeepAlives = bc.DisableKeepAlives
+	return t
+}
+
+// newDialer creates a dialer racing IPv6 and IPv4 addresses happy eyeballs
+// style, the second family is tried after the configured fallback delay
+func newDialer(cfg *Config, timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:       timeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: cfg.DialFallbackDelay.Duration,
+	}
+}
+
+// errorStatus maps an error from forwarding to a backend to the status the
+// client gets: 504 if the backend ran out of time, 502 for anything else
+// the backend got wrong, 503 is kept for having no backend to ask at all
+func errorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// readLoad takes the load report off the response, responses without
+// a valid report leave the backend's load as it was
+func (lb *LoadBalancer) readLoad(b *Backend, resp *http.Response) {
+	if lb.cfg.LoadHeader == "" {
+		return
+	}
+	v := resp.Header.Get(lb.cfg.LoadHeader)
+	if v == "" {
+		return
+	}
+	resp.Header.Del(lb.cfg.LoadHeader)
+	load, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return
+	}
+	b.ReportLoad(load)
+}
+
+// readDrain drains the backend when the response says it is shutting down
+func (lb *LoadBalancer) readDrain(b *Backend, resp *http.Response) {
+	drain := lb.cfg.DrainOnConnectionClose && resp.Close
+	if lb.cfg.DrainHeader != "" {
+		if v := resp.Header.Get(lb.cfg.DrainHeader); v != "" {
+			resp.Header.Del(lb.cfg.DrainHeader)
+			if ok, _ := strconv.ParseBool(v); ok {
+				drain = true
+			}
+		}
+	}
+	if drain && !b.Draining() {
+		fmt.Printf("server %s is draining\n", b.URL)
+		b.Drain()
+		lb.rebuildSelectable()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSaturatedBackendsAnswer503(t *testing.T) {
+	release := make(chan struct{})
+	blocking := func() *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	a, b := blocking(), blocking()
+	lb := newTestLoadBalancer(t, []string{a.URL, b.URL}, func(cfg *Config) {
+		for i := range cfg.Backends {
+			cfg.Backends[i].MaxConns = 1
+		}
+	})
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Go(func() {
+			if rec := do(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusOK {
+				t.Errorf("status %d while a backend had room, want 200", rec.Code)
+			}
+		})
+	}
+	waitFor(t, func() bool {
+		return lb.Backends()[0].ActiveConns() == 1 && lb.Backends()[1].ActiveConns() == 1
+	})
+
+	if rec := do(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d with every backend at max_conns, want 503", rec.Code)
+	}
+	for _, b := range lb.Backends() {
+		if n := b.ActiveConns(); n > 1 {
+			t.Errorf("%s has %d requests in flight, max_conns is 1", b.URL, n)
+		}
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestExpectContinueWaitsForTheBackend(t *testing.T) {
+	var got atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			// answered without reading the body, the client mustn't send it
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		got.Store(string(body))
+	}))
+	defer backend.Close()
+	lb := newTestLoadBalancer(t, []string{backend.URL}, nil)
+	front := httptest.NewServer(lb)
+	defer front.Close()
+
+	send := func(path string) (*bufio.Reader, net.Conn) {
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: lb\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", path)
+		return bufio.NewReader(conn), conn
+	}
+
+	br, conn := send("/reject")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("rejected upload: status %d, want the backend's 403 without a 100 Continue", resp.StatusCode)
+	}
+	conn.Close()
+
+	br, conn = send("/upload")
+	defer conn.Close()
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("accepted upload: status %d, want 100 Continue first", resp.StatusCode)
+	}
+	conn.Write([]byte("hello"))
+	if resp, err = http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || got.Load() != "hello" {
+		t.Errorf("status %d, backend got %q, want 200 and the body", resp.StatusCode, got.Load())
+	}
+}
+
+func TestAbortedResponseReleasesTheBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		// cut the body short, the proxy panics to abort the client's response
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+	lb := newTestLoadBalancer(t, []string{backend.URL}, nil)
+	front := httptest.NewServer(lb)
+	defer front.Close()
+
+	for range 3 {
+		// the abort shows as a failed request or a truncated body,
+		// depending on whether the headers went out
+		resp, err := http.Get(front.URL)
+		if err != nil {
+			continue
+		}
+		if _, err := io.ReadAll(resp.Body); err == nil {
+			t.Error("truncated body read without an error")
+		}
+		resp.Body.Close()
+	}
+	b := lb.Backends()[0]
+	waitFor(t, func() bool { return b.ActiveConns() == 0 })
+	if n := b.requests.Load(); n != 3 {
+		t.Errorf("%d requests counted, want 3", n)
+	}
+}
+
+func TestRateQueueHoldsNoConnectionSlot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	lb := newTestLoadBalancer(t, []string{srv.URL}, func(cfg *Config) {
+		// a turn every 200ms
+		cfg.Backends[0].MaxRate = 5
+		cfg.Backends[0].MaxConns = 1
+	})
+	b := lb.Backends()[0]
+
+	if rec := do(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("first request status %d, want 200", rec.Code)
+	}
+	done := make(chan int)
+	go func() {
+		done <- do(lb, httptest.NewRequest(http.MethodGet, "/", nil)).Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := b.ActiveConns(); n != 0 {
+		t.Errorf("%d connection slots held by a request waiting for its turn", n)
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("queued request status %d, want 200", code)
+	}
+}
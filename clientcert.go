@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultClientCertFields are the XFCC fields sent when none are configured
+var defaultClientCertFields = []string{"hash", "subject", "uri", "dns"}
+
+// clientAuth returns how the listener asks clients for certificates and
+// the CAs their certificates are verified against
+func clientAuth(cfg *TLSConfig) (tls.ClientAuthType, *x509.CertPool, error) {
+	var auth tls.ClientAuthType
+	switch cfg.ClientAuth {
+	case "", "none":
+		return tls.NoClientCert, nil, nil
+	case "request":
+		return tls.RequestClientCert, nil, nil
+	case "verify-if-given":
+		auth = tls.VerifyClientCertIfGiven
+	case "require":
+		auth = tls.RequireAndVerifyClientCert
+	default:
+		return 0, nil, fmt.Errorf("unknown client_auth %q", cfg.ClientAuth)
+	}
+	pool, err := loadCertPool(cfg.ClientCAFile)
+	if err != nil {
+		return 0, nil, fmt.Errorf("client_ca_file: %w", err)
+	}
+	return auth, pool, nil
+}
+
+// loadCertPool reads the PEM certificates in the file into a pool
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates", file)
+	}
+	return pool, nil
+}
+
+// forwardClientCert replaces the client cert header on a request going to
+// a backend with one describing the certificate the client presented, a
+// header sent by the client itself is never passed on as it could be forged
+func (lb *LoadBalancer) forwardClientCert(r *http.Request) {
+	fc := lb.cfg.ForwardClientCert
+	if fc == nil {
+		return
+	}
+	r.Header.Del(fc.Header)
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return
+	}
+	fields := fc.Fields
+	if len(fields) == 0 {
+		fields = defaultClientCertFields
+	}
+	r.Header.Set(fc.Header, xfcc(r.TLS.PeerCertificates[0], fields))
+}
+
+// xfcc formats the certificate in the X-Forwarded-Client-Cert format
+// Envoy uses, key=value pairs separated by semicolons
+func xfcc(cert *x509.Certificate, fields []string) string {
+	var parts []string
+	for _, field := range fields {
+		switch field {
+		case "hash":
+			sum := sha256.Sum256(cert.Raw)
+			parts = append(parts, "Hash="+hex.EncodeToString(sum[:]))
+		case "subject":
+			parts = append(parts, "Subject="+xfccQuote(cert.Subject.String()))
+		case "uri":
+			for _, u := range cert.URIs {
+				parts = append(parts, "URI="+xfccValue(u.String()))
+			}
+		case "dns":
+			for _, name := range cert.DNSNames {
+				parts = append(parts, "DNS="+xfccValue(name))
+			}
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// xfccValue quotes the value if it holds characters that separate XFCC fields
+func xfccValue(v string) string {
+	if strings.ContainsAny(v, `,;="`) {
+		return xfccQuote(v)
+	}
+	return v
+}
+
+func xfccQuote(v string) string {
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
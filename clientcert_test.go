@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed certificate for 127.0.0.1 and its
+// key to PEM files in dir
+func writeSelfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "load balancer"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "lb.pem"), filepath.Join(dir, "lb-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReencryptsToBackends(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			http.Error(w, "plaintext", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("secret"))
+	}))
+	defer backend.Close()
+	dir := t.TempDir()
+	backendCA := filepath.Join(dir, "backend-ca.pem")
+	writePEM(t, backendCA, "CERTIFICATE", backend.Certificate().Raw)
+	certFile, keyFile := writeSelfSigned(t, dir)
+
+	// the listener serves the certificate Run would, httptest would put
+	// its own in front of GetCertificate for clients that send no SNI
+	front := func(lb *LoadBalancer) *httptest.Server {
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := certs.GetCertificate(nil)
+		srv := httptest.NewUnstartedServer(lb)
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	lbCerts, err := loadCertPool(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: lbCerts}}}
+
+	lb := newTestLoadBalancer(t, []string{backend.URL}, func(cfg *Config) {
+		cfg.TLS = &TLSConfig{CertFile: certFile, KeyFile: keyFile}
+		cfg.BackendCAFile = backendCA
+	})
+	resp, err := client.Get(front(lb).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "secret" {
+		t.Fatalf("got %d %q, want the backend's answer over TLS", resp.StatusCode, body)
+	}
+	clientLeg := resp.TLS.PeerCertificates[0]
+	if clientLeg.Equal(backend.Certificate()) {
+		t.Error("the client got the backend's certificate, want the load balancer's own")
+	}
+	if clientLeg.Subject.CommonName != "load balancer" {
+		t.Errorf("client leg certificate %q, want the load balancer's", clientLeg.Subject.CommonName)
+	}
+
+	// the backend leg is verified against the backend CAs, not trusted blindly
+	lb = newTestLoadBalancer(t, []string{backend.URL}, func(cfg *Config) {
+		cfg.TLS = &TLSConfig{CertFile: certFile, KeyFile: keyFile}
+		cfg.BackendCAFile = certFile
+	})
+	resp, err = client.Get(front(lb).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status %d with a backend certificate the CAs don't vouch for, want 502", resp.StatusCode)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultCoalesceHeaders are the request headers that tell otherwise
+// identical requests apart when no list is configured
+var defaultCoalesceHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie"}
+
+// coalescer collapses concurrent identical requests into a single upstream
+// call whose response is handed to every waiting client
+type coalescer struct {
+	headers []string
+	mu      sync.Mutex
+	calls   map[string]*flight
+}
+
+// flight is an upstream call in progress, res is nil if it was aborted
+type flight struct {
+	done chan struct{}
+	res  *responseRecorder
+}
+
+func newCoalescer(headers []string) *coalescer {
+	if len(headers) == 0 {
+		headers = defaultCoalesceHeaders
+	}
+	return &coalescer{headers: headers, calls: make(map[string]*flight)}
+}
+
+// coalescable reports whether the request is safe to share a response for
+func coalescable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.Header.Get("Upgrade") == ""
+}
+
+func (c *coalescer) key(r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(r.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(r.Host)
+	sb.WriteString(r.URL.RequestURI())
+	if m := routeFrom(r.Context()); m != nil {
+		// A/B variants of a route answer the same request differently
+		sb.WriteString(" " + m.pool)
+	}
+	for _, h := range c.headers {
+		sb.WriteByte('\n')
+		sb.WriteString(h)
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return sb.String()
+}
+
+func (c *coalescer) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	key := c.key(r)
+
+	c.mu.Lock()
+	if f, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return
+		}
+		if f.res == nil {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		f.res.writeTo(w)
+		return
+	}
+	f := &flight{done: make(chan struct{})}
+	c.calls[key] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+
+	// the response is shared, so the first client going away must not cancel it
+	rec := newResponseRecorder()
+	next(rec, r.WithContext(context.WithoutCancel(r.Context())))
+	f.res = rec
+	rec.writeTo(w)
+}
+
+// responseRecorder buffers a response so it can be written more than once
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header)}
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(p)
+}
+
+// writeTo replays the response, the values of the trailers it declared
+// are held back until after the body so they go out as trailers again
+// rather than as headers
+func (rec *responseRecorder) writeTo(w http.ResponseWriter) {
+	trailers := declaredTrailers(rec.header)
+	h := w.Header()
+	for k, v := range rec.header {
+		if !trailers[k] {
+			h[k] = append([]string(nil), v...)
+		}
+	}
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(rec.body.Bytes())
+	for k := range trailers {
+		if v, ok := rec.header[k]; ok {
+			h[k] = append([]string(nil), v...)
+		}
+	}
+}
+
+// declaredTrailers returns the trailer names the Trailer header announces
+func declaredTrailers(h http.Header) map[string]bool {
+	trailers := make(map[string]bool)
+	for _, v := range h.Values("Trailer") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				trailers[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	return trailers
+}
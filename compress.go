@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type upstreamGzipKey struct{}
+
+// requestUpstreamGzip asks the backend for a gzip response if the
+// request's pool is set to, remembering whether the client takes gzip
+// itself so gunzipResponse knows to decompress for it. Range requests are
+// left alone, a slice of a gzip stream can't be decompressed.
+func (lb *LoadBalancer) requestUpstreamGzip(r *http.Request) {
+	m := routeFrom(r.Context())
+	if m == nil || !slices.Contains(lb.cfg.UpstreamGzipPools, m.pool) || r.Header.Get("Range") != "" {
+		return
+	}
+	clientGzip := acceptsGzip(r.Header.Values("Accept-Encoding"))
+	r.Header.Set("Accept-Encoding", "gzip")
+	*r = *r.WithContext(context.WithValue(r.Context(), upstreamGzipKey{}, clientGzip))
+}
+
+// gunzipResponse decompresses a gzip response the load balancer asked
+// for on behalf of a client that didn't. Only full 200 responses are,
+// others and empty bodies are passed on as they are.
+func gunzipResponse(resp *http.Response) error {
+	clientGzip, forced := resp.Request.Context().Value(upstreamGzipKey{}).(bool)
+	if !forced || clientGzip || resp.Header.Get("Content-Encoding") != "gzip" ||
+		resp.Request.Method == http.MethodHead || resp.StatusCode != http.StatusOK || resp.ContentLength == 0 {
+		return nil
+	}
+	br := bufio.NewReader(resp.Body)
+	if _, err := br.Peek(1); err == io.EOF {
+		resp.Body = readCloser{br, resp.Body}
+		return nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return err
+	}
+	resp.Body = readCloser{zr, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+// acceptsGzip reports whether Accept-Encoding values allow a gzip response
+func acceptsGzip(values []string) bool {
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUpstreamGzip(t *testing.T) {
+	body := gzipped(t, "hello world")
+	var gotEncoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Accept-Encoding")
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte("hello world"))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/empty":
+		case "/empty-chunked":
+			w.(http.Flusher).Flush()
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(body)
+		default:
+			w.Write(body)
+		}
+	}))
+	defer srv.Close()
+	lb := newTestLoadBalancer(t, []string{srv.URL}, func(cfg *Config) {
+		cfg.UpstreamGzipPools = []string{""}
+	})
+
+	rec := do(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	if gotEncoding != "gzip" || rec.Code != http.StatusOK || rec.Body.String() != "hello world" {
+		t.Fatalf("backend asked for %q, client got %d %q", gotEncoding, rec.Code, rec.Body)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=0-4")
+	if rec := do(lb, r); gotEncoding != "" || rec.Code != http.StatusOK || rec.Body.String() != "hello world" {
+		t.Fatalf("range request: backend asked for %q, client got %d %q", gotEncoding, rec.Code, rec.Body)
+	}
+
+	for _, path := range []string{"/empty", "/empty-chunked"} {
+		if rec := do(lb, httptest.NewRequest(http.MethodGet, path, nil)); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+			t.Fatalf("%s: got %d %q", path, rec.Code, rec.Body)
+		}
+	}
+
+	rec = do(lb, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if rec.Code != http.StatusNotFound || !bytes.Equal(rec.Body.Bytes(), body) {
+		t.Fatalf("404: got %d %q, want it passed through", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notModifiedHeaders are the headers of a cached response a 304 repeats
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Vary"}
+
+// notModified reports whether a conditional GET is answered by a 304 given
+// the validators of the response it would get. If-None-Match takes
+// precedence, If-Modified-Since is only looked at without it.
+func notModified(r *http.Request, h http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := h.Get("ETag")
+		return etag != "" && matchETag(inm, etag, false)
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	// the dates have a resolution of a second
+	return !lastModified.Truncate(time.Second).After(ims)
+}
+
+// matchETag reports whether etag is one of the entity tags in list, a
+// comma separated list as in If-None-Match or "*" which matches any. The
+// strong comparison wants both tags strong and the same, the weak one,
+// used by If-None-Match, ignores the W/ prefix.
+func matchETag(list, etag string, strong bool) bool {
+	want, wantWeak, ok := parseETag(etag)
+	if !ok || (strong && wantWeak) {
+		return false
+	}
+	for list = strings.TrimSpace(list); list != ""; {
+		if list[0] == ',' {
+			list = strings.TrimSpace(list[1:])
+			continue
+		}
+		if list[0] == '*' {
+			return true
+		}
+		tag, rest := cutETag(list)
+		if tag == "" {
+			// not an entity tag, nothing after it can be trusted
+			return false
+		}
+		opaque, weak, _ := parseETag(tag)
+		if opaque == want && !(strong && weak) {
+			return true
+		}
+		list = strings.TrimSpace(rest)
+	}
+	return false
+}
+
+// cutETag splits the entity tag at the start of s from the rest, the tag
+// is empty if s doesn't start with one. Entity tags may hold commas, the
+// quotes tell where they end.
+func cutETag(s string) (tag, rest string) {
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) <= start || s[start] != '"' {
+		return "", s
+	}
+	end := strings.IndexByte(s[start+1:], '"')
+	if end < 0 {
+		return "", s
+	}
+	end += start + 2
+	return s[:end], s[end:]
+}
+
+// parseETag returns the quoted opaque tag of an entity tag and whether it
+// is weak
+func parseETag(s string) (opaque string, weak, ok bool) {
+	s = strings.TrimSpace(s)
+	s, weak = strings.CutPrefix(s, "W/")
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' || strings.Contains(s[1:len(s)-1], `"`) {
+		return "", false, false
+	}
+	return s, weak, true
+}
+
+// fresh returns the cached response for the request if it is still fresh,
+// younger than its max-age, so it can validate a conditional request in
+// place of the backend
+func (c *staleCache) fresh(r *http.Request) *staleEntry {
+	key, ok := readKey(r.Context())
+	if !ok {
+		return nil
+	}
+	e := c.lookup(key, r.Method)
+	if e == nil || !time.Now().Before(e.freshUntil) {
+		return nil
+	}
+	return e
+}
+
+// writeNotModified answers with a 304 carrying the entry's validators
+func (e *staleEntry) writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	for _, k := range notModifiedHeaders {
+		if v := e.header.Values(k); len(v) > 0 {
+			h[k] = v
+		}
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// writeHead answers a HEAD request with the headers of the entry, which
+// may come from a GET
+func (e *staleEntry) writeHead(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range e.header.Clone() {
+		h[k] = v
+	}
+	if !e.head {
+		h.Set("Content-Length", strconv.Itoa(len(e.body)))
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	w.WriteHeader(e.status)
+}
@@ -0,0 +1,1149 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configMigrations upgrade a config file one schema version at a time,
+// configMigrations[i] takes a version i+1 file to version i+2. Fields that
+// are only added need no migration, the defaults fill them in.
+var configMigrations []func(raw map[string]json.RawMessage) error
+
+// configVersion is the schema version of the current config format
+var configVersion = len(configMigrations) + 1
+
+// Config holds the load balancer settings
+type Config struct {
+	// Version is the config schema version, files without one are version 1
+	Version int `json:"version"`
+	Port    int `json:"port"`
+	// AdminPort serves the admin API, 0 disables it
+	AdminPort           int             `json:"admin_port"`
+	Backends            []BackendConfig `json:"backends"`
+	HealthCheckInterval Duration        `json:"health_check_interval"`
+	// HealthCheckConnectTimeout bounds the dial of network probes and
+	// HealthCheckReadTimeout the wait for an http probe's answer once
+	// connected, so probes of dead backends can fail faster than a probe's
+	// timeout, 0 leaves it to the probe's timeout
+	HealthCheckConnectTimeout Duration `json:"health_check_connect_timeout"`
+	HealthCheckReadTimeout    Duration `json:"health_check_read_timeout"`
+	// HealthChecks are the probes run against every backend, a TCP dial when empty
+	HealthChecks []ProbeConfig `json:"health_checks"`
+	// HealthCheckHeaders are sent with every http probe, such as Authorization,
+	// User-Agent or Host
+	HealthCheckHeaders map[string]string `json:"health_check_headers"`
+	// StartupGracePeriod is how long after startup backends that are not up
+	// yet are probed every StartupProbeInterval instead of their interval,
+	// 0 disables the faster probing
+	StartupGracePeriod   Duration `json:"startup_grace_period"`
+	StartupProbeInterval Duration `json:"startup_probe_interval"`
+	// PoolHealth overrides the health check settings for the backends of the
+	// named pools, settings a pool leaves unset come from the global ones
+	PoolHealth map[string]*PoolHealthConfig `json:"pool_health"`
+	// HealthPolicy combines the probe outcomes: "all" must pass (the default),
+	// "any" must pass, or "weighted" where the passing probes' share of the
+	// total weight must reach HealthThreshold
+	HealthPolicy    string  `json:"health_policy"`
+	HealthThreshold float64 `json:"health_threshold"`
+	// StatsWindow is the window traffic shares in the stats are computed over
+	StatsWindow Duration `json:"stats_window"`
+	// listener limits, a zero timeout means no timeout
+	ReadTimeout       Duration `json:"read_timeout"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	// WriteTimeout also bounds streamed and long polling responses, gRPC
+	// streams included
+	WriteTimeout   Duration `json:"write_timeout"`
+	IdleTimeout    Duration `json:"idle_timeout"`
+	MaxHeaderBytes int      `json:"max_header_bytes"`
+	// H2C accepts HTTP/2 without TLS from clients that know the load balancer
+	// speaks it, which cleartext gRPC clients need
+	H2C bool `json:"h2c"`
+	// MinBodyRate is the slowest a client may send a request body at, in
+	// bytes per second since the body was first read, once MinBodyRateGrace
+	// has passed. Slower clients get a 408. 0 is no limit, the grace
+	// period defaults to 5s. gRPC calls are exempt, a client stream may
+	// sit idle between messages.
+	MinBodyRate      int64    `json:"min_body_rate"`
+	MinBodyRateGrace Duration `json:"min_body_rate_grace"`
+	// MaxResponseBytes caps the size of a backend response body, larger
+	// responses are answered with a 502 or cut off if already streaming,
+	// 0 is no limit. gRPC calls are exempt, a server stream has no end to
+	// its size.
+	MaxResponseBytes int64 `json:"max_response_bytes"`
+	// ShutdownTimeout is how long requests in flight get to finish on shutdown
+	// or after handing the listeners to an upgraded process
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// DialFallbackDelay is how long a connection attempt to a backend's first
+	// address family gets before the other family is raced against it,
+	// negative disables the race
+	DialFallbackDelay Duration `json:"dial_fallback_delay"`
+	// ExpectContinueTimeout is how long to wait for a backend's 100 Continue
+	// before sending the body anyway
+	ExpectContinueTimeout Duration `json:"expect_continue_timeout"`
+	// RequestTimeout bounds each attempt at a request, from sending it to the
+	// end of the response, backends can override it, 0 is no limit
+	RequestTimeout Duration `json:"request_timeout"`
+	// TotalRequestTimeout bounds a request across all its attempts, 0 is no
+	// limit. Neither bounds gRPC calls, a stream lives as long as the call
+	// and the call's deadline travels with it in grpc-timeout.
+	TotalRequestTimeout Duration `json:"total_request_timeout"`
+	// MaxRetries is how many other backends a request that failed before
+	// reaching its backend is tried on, 0 disables retries
+	MaxRetries int `json:"max_retries"`
+	// RetryBackoff waits between retries so a recovering backend isn't
+	// hammered, retries go out right away when unset
+	RetryBackoff *RetryBackoffConfig `json:"retry_backoff"`
+	// RetryBudget caps the retries at a share of all requests, once spent
+	// failed requests are answered rather than sent to another backend
+	RetryBudget *RetryBudgetConfig `json:"retry_budget"`
+	// AccessLog writes a JSON line for every request to stdout
+	AccessLog bool `json:"access_log"`
+	// AccessLogFields are the fields access log lines carry, all of them
+	// when empty, see accessLogFields for the names
+	AccessLogFields []string `json:"access_log_fields"`
+	// ErrorLogLimit is how many request errors of one kind are logged per
+	// backend each ErrorLogInterval, the rest are summed up in one line at
+	// the end of the interval, 0 logs every error
+	ErrorLogLimit    int      `json:"error_log_limit"`
+	ErrorLogInterval Duration `json:"error_log_interval"`
+	// FailFast limits backends failing requests in a row to a trickle of
+	// probe requests until one succeeds, instead of ejecting them
+	FailFast *FailFastConfig `json:"fail_fast"`
+	// DegradedThreshold is the share of a pool's backends that must be alive,
+	// below it the pool is reported degraded, 0 disables the check
+	DegradedThreshold float64 `json:"degraded_threshold"`
+	// HealthCheckFailOpen keeps every backend in rotation when they all fail
+	// the same check, on the assumption the checker rather than the backends broke
+	HealthCheckFailOpen bool `json:"health_check_fail_open"`
+	// Strategy is the backend selection strategy: round-robin, least-connections,
+	// least-load, ip-hash, consistent-hash, weighted-consistent-hash or
+	// weighted-round-robin
+	Strategy string `json:"strategy"`
+	// HashKey is what consistent-hash and weighted-consistent-hash hash
+	// requests on: "path" (the default), "query:<param>", "header:<name>"
+	// or "cookie:<name>"
+	HashKey string `json:"hash_key"`
+	// SelectionSeed seeds the random strategies so their picks can be
+	// reproduced when debugging, 0 seeds them randomly
+	SelectionSeed int64 `json:"selection_seed"`
+	// StrategyChain replaces Strategy with a list of strategies tried in
+	// order, each falling through to the next when it can't pick a backend
+	StrategyChain []StrategyStepConfig `json:"strategy_chain"`
+	// AffinityHeader pins requests with the same value of this header to the same backend
+	AffinityHeader string `json:"affinity_header"`
+	// StickyCookie keeps clients on the same backend with a cookie
+	StickyCookie *StickyCookieConfig `json:"sticky_cookie"`
+	// LocalZone is the zone the load balancer runs in, same-zone backends are preferred
+	LocalZone string `json:"local_zone"`
+	// GeoIP locates clients and prefers the backends labeled with the
+	// region they are mapped to
+	GeoIP *GeoIPConfig `json:"geoip"`
+	// LoadHeader is the response header backends report their load in (0.0-1.0)
+	LoadHeader string `json:"load_header"`
+	// DrainHeader is the response header a shutting down backend sets to "true",
+	// it is then sent no new requests until it passes a health check
+	DrainHeader string `json:"drain_header"`
+	// DrainOnConnectionClose also drains backends that respond with Connection: close
+	DrainOnConnectionClose bool `json:"drain_on_connection_close"`
+	// ForwardClientCert tells backends about the certificate the client
+	// presented, for mutual TLS setups where they authorize on it
+	ForwardClientCert *ForwardClientCertConfig `json:"forward_client_cert"`
+	// ResponseHeaders are set on every response, values may use {instance},
+	// {backend}, {pool} and {route}, a value that comes out empty removes
+	// the header, such as a Server header that gives away the backend
+	ResponseHeaders map[string]string `json:"response_headers"`
+	// InstanceName identifies this load balancer in response headers,
+	// defaults to the hostname
+	InstanceName string `json:"instance_name"`
+	// StripRequestHeaders are removed from requests before they are forwarded
+	// so clients can't set them, a trailing * matches any suffix as in "X-Internal-*"
+	StripRequestHeaders []string `json:"strip_request_headers"`
+	// RewriteRedirects points Location headers naming a backend at the
+	// host and scheme the client used instead
+	RewriteRedirects bool `json:"rewrite_redirects"`
+	// RedirectHosts maps internal hosts, with their port if the Location
+	// has one, to the public base URL their Location headers are rewritten
+	// to, as in "app.internal:8080": "https://www.example.com"
+	RedirectHosts map[string]string `json:"redirect_hosts"`
+	// RequestID is the format of the ID every request is given, unless it
+	// comes with a valid one, and logged with: "x-request-id" for an
+	// X-Request-ID header also sent back to the client, "traceparent" for a
+	// W3C traceparent header whose trace ID is logged, empty for none
+	RequestID string `json:"request_id"`
+	// PreserveRequestHeaders are hop-by-hop headers forwarded to the backend
+	// anyway, such as Proxy-Authorization
+	PreserveRequestHeaders []string `json:"preserve_request_headers"`
+	// UpstreamGzipPools are the pools whose backends are always asked for gzip
+	// responses to save bandwidth, responses to clients that don't take
+	// gzip are decompressed by the load balancer
+	UpstreamGzipPools []string `json:"upstream_gzip_pools"`
+	// AdaptiveConcurrency learns how many concurrent requests each backend
+	// handles best from its response times and caps it there, on top of
+	// any max_conns
+	AdaptiveConcurrency *AdaptiveConcurrencyConfig `json:"adaptive_concurrency"`
+	// ErrorRateAlert is the share of a backend's requests in a stats window
+	// that may fail, 5xx responses included, before a high_error_rate event
+	// is emitted, 0 disables it
+	ErrorRateAlert float64 `json:"error_rate_alert"`
+	// Webhook gets the events: backends going up or down, pools degrading
+	// or recovering and high error rates
+	Webhook *WebhookConfig `json:"webhook"`
+	// MaxInFlight caps the requests the load balancer serves at once across
+	// all backends, the rest are answered with 503, 0 is no limit
+	MaxInFlight int64 `json:"max_in_flight"`
+	// Coalesce collapses concurrent identical GET and HEAD requests into one upstream call
+	Coalesce bool `json:"coalesce"`
+	// CoalesceHeaders are the request headers that must match for requests to be coalesced
+	CoalesceHeaders []string `json:"coalesce_headers"`
+	// AutoWeight periodically derives backend weights from their response times
+	AutoWeight *AutoWeightConfig `json:"auto_weight"`
+	// ProbeWeight derives backend weights from their health probe latency
+	ProbeWeight *ProbeWeightConfig `json:"probe_weight"`
+	// DistributionAudit periodically checks that weighted-round-robin spreads
+	// requests as the weights ask and logs the backends that drift off
+	DistributionAudit *DistributionAuditConfig `json:"distribution_audit"`
+	// NormalizePath cleans request paths before they are routed, coalesced
+	// and forwarded: duplicate slashes are collapsed and dot segments resolved
+	NormalizePath bool `json:"normalize_path"`
+	// TrailingSlash is what normalizing does with a trailing slash: keep it
+	// as sent (the default), "strip" it or "add" it
+	TrailingSlash string `json:"trailing_slash"`
+	// Routes send matching requests to a pool, the first matching route wins
+	// and routes are tried before the TLS server name
+	Routes []RouteConfig `json:"routes"`
+	// DefaultPool serves the requests no routing rule matches, empty is the pool
+	// of backends without a pool name, requests are answered with 404 when it
+	// has no backends
+	DefaultPool string `json:"default_pool"`
+	// Rewrite replaces strings in the bodies of matching responses
+	Rewrite *RewriteConfig `json:"rewrite"`
+	// Pin lets trusted clients send a request to a backend of their choosing
+	// for debugging, it is off when unset
+	Pin *PinConfig `json:"pin"`
+	// Override lets callers holding a token signed with its secret send a
+	// request to a backend or pool of their choosing, it is off when unset
+	Override *OverrideConfig `json:"override"`
+	// SorryBackend gets the requests no backend can take, typically a
+	// maintenance page, instead of answering them with a 503
+	SorryBackend *BackendConfig `json:"sorry_backend"`
+	// RequestCost estimates what requests cost the backends, the strategies
+	// then balance the cost rather than the number of requests
+	RequestCost *RequestCostConfig `json:"request_cost"`
+	// DualWrite sends write requests to a secondary backend as well and logs
+	// where its answers differ from the primary's, for testing a migration
+	DualWrite *DualWriteConfig `json:"dual_write"`
+	// Maintenance serves a static maintenance page in place of the 503 for
+	// requests no backend can take, and for every request in maintenance mode
+	Maintenance *MaintenanceConfig `json:"maintenance"`
+	// DuplicateBackends is what to do with backends listed more than once,
+	// going by scheme, host and port: "reject" the config (the default) or
+	// "merge" them into one backend with the sum of their weights. Backends
+	// added through the admin API are held to the same policy.
+	DuplicateBackends string `json:"duplicate_backends"`
+	// BackendLookupIgnoresScheme lets the admin API find a backend by host and
+	// port alone, so http://host:8080 and https://host:8080 name the same one
+	BackendLookupIgnoresScheme bool `json:"backend_lookup_ignores_scheme"`
+	// StateFile keeps the weights set, backends drained and backends removed
+	// through the admin API across restarts, they take precedence over the
+	// config, empty keeps them in memory only
+	StateFile string `json:"state_file"`
+	// StateStore keeps the same state somewhere other than a file, for
+	// programs embedding the load balancer, it takes precedence over
+	// StateFile
+	StateStore StateStore `json:"-"`
+	// SelfTestPath is the path the admin API's /selftest requests through
+	// the load balancer, "/" by default, with SelfTestHost as its Host if set
+	SelfTestPath string `json:"self_test_path"`
+	SelfTestHost string `json:"self_test_host"`
+	// DebugBufferSize is how many of the last requests are kept for the admin
+	// API's /debug/requests, 0 disables it
+	DebugBufferSize int `json:"debug_buffer_size"`
+	// TLS terminates client TLS on the main listener when set
+	TLS *TLSConfig `json:"tls"`
+	// CORS is the policy the load balancer answers CORS preflights with on
+	// routes that handle OPTIONS, their other responses allow the origin too
+	CORS *CORSConfig `json:"cors"`
+	// StaleIfError keeps a copy of the responses to cacheable GET and HEAD
+	// requests and serves it with a Warning header, rather than an error,
+	// while the backends fail. Conditional requests the copy validates get
+	// a 304 without reaching the backends while it is fresh.
+	StaleIfError *StaleIfErrorConfig `json:"stale_if_error"`
+	// BackendCAFile holds the CAs the certificates of https backends are
+	// verified against, for traffic and health probes alike, instead of the
+	// system roots. With TLS set requests are re-encrypted to the backends.
+	BackendCAFile string `json:"backend_ca_file"`
+}
+
+// RouteConfig sends the requests meeting all of its conditions to a pool,
+// unset conditions match any request
+type RouteConfig struct {
+	// Name labels the route's requests in metrics and logs, defaults to the pool
+	Name string `json:"name"`
+	// Host is the request host, "*.example.com" matches any single label subdomain
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix"`
+	// Query are query parameters the request must carry with the given
+	// value, "*" accepts any value, a missing parameter never matches
+	Query map[string]string `json:"query"`
+	Pool  string            `json:"pool"`
+	// BackendLabels limits the route to the pool's backends carrying these
+	// labels, the version an http probe's version_field reads is the
+	// "version" label, so a route can follow a rollout
+	BackendLabels map[string]string `json:"backend_labels"`
+	// HandleOptions has the load balancer answer OPTIONS requests itself,
+	// CORS preflights with the CORS policy, rather than forward them to
+	// backends that implement OPTIONS themselves
+	HandleOptions bool `json:"handle_options"`
+	// GRPCWeb translates gRPC-Web requests to gRPC over HTTP/2 for the
+	// pool's backends and their responses back to gRPC-Web
+	GRPCWeb bool `json:"grpc_web"`
+	// Split sends the route's clients to variant pools for A/B tests,
+	// clients in no variant's buckets or without the identifier stay on Pool
+	Split *SplitConfig `json:"split"`
+}
+
+// SplitConfig assigns clients to one of 100 buckets by a hash of Key, a
+// stable identifier given as "cookie:<name>", "header:<name>" or
+// "query:<param>", the same client always lands in the same bucket. Salt
+// sets experiments using the same identifier apart.
+type SplitConfig struct {
+	Key      string          `json:"key"`
+	Salt     string          `json:"salt"`
+	Variants []VariantConfig `json:"variants"`
+}
+
+// VariantConfig sends the buckets from Buckets[0] to Buckets[1], both
+// included, to Pool, Name labels the variant in logs and defaults to Pool
+type VariantConfig struct {
+	Name    string `json:"name"`
+	Buckets [2]int `json:"buckets"`
+	Pool    string `json:"pool"`
+}
+
+// WebhookConfig describes the webhook events are POSTed to, Secret signs
+// them, QueueSize is how many undelivered events are kept, 100 by default,
+// MaxRetries how often a failed delivery is retried, 3 by default, and
+// Timeout bounds each attempt, 5s by default
+type WebhookConfig struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	QueueSize  int      `json:"queue_size"`
+	MaxRetries int      `json:"max_retries"`
+	Timeout    Duration `json:"timeout"`
+}
+
+// AdaptiveConcurrencyConfig bounds the learned concurrency limits, they
+// start at InitialLimit, 20 by default, and stay between MinLimit and
+// MaxLimit, 1 and 1000 by default
+type AdaptiveConcurrencyConfig struct {
+	InitialLimit int `json:"initial_limit"`
+	MinLimit     int `json:"min_limit"`
+	MaxLimit     int `json:"max_limit"`
+}
+
+// StaleIfErrorConfig describes the stale cache, a response may be served
+// until its max-age plus its stale-if-error have passed, MaxStale stands
+// in for stale-if-error if the response has none, 0 keeps only the
+// responses that do. MaxEntries defaults to 1000 and MaxBodyBytes to 1MB.
+type StaleIfErrorConfig struct {
+	MaxStale     Duration `json:"max_stale"`
+	MaxEntries   int      `json:"max_entries"`
+	MaxBodyBytes int64    `json:"max_body_bytes"`
+	// BypassHeader set to a true value skips the cache reads, the fresh
+	// response is still kept, defaults to X-Cache-Bypass. It is only
+	// honored from BypassTrustedCIDRs, loopback by default.
+	BypassHeader       string   `json:"bypass_header"`
+	BypassTrustedCIDRs []string `json:"bypass_trusted_cidrs"`
+	// Head is how HEAD requests use the cache: "stale", the default,
+	// answers them when GET requests would be, from an entry kept from a
+	// GET or a HEAD for the URL, "fresh" also answers them from fresh
+	// entries without asking a backend and "off" leaves them out
+	Head string `json:"head"`
+	// StoreWithoutCacheControl keeps responses that have no Cache-Control
+	// header, by default only responses whose Cache-Control allows it are
+	// kept. Only set it if no backend answers differently per client
+	// without saying so.
+	StoreWithoutCacheControl bool `json:"store_without_cache_control"`
+}
+
+// GeoIPConfig maps clients to regions, Database is a MaxMind country or
+// city database, Countries map ISO country codes and Continents two letter
+// continent codes to the value of the backends' region label, a country
+// mapping wins over its continent's
+type GeoIPConfig struct {
+	Database   string            `json:"database"`
+	Countries  map[string]string `json:"countries"`
+	Continents map[string]string `json:"continents"`
+}
+
+// CORSConfig is a CORS policy, AllowOrigins are the origins allowed, "*"
+// allows any, AllowMethods default to GET, HEAD and POST and AllowHeaders
+// to the headers the preflight asks for
+type CORSConfig struct {
+	AllowOrigins     []string `json:"allow_origins"`
+	AllowMethods     []string `json:"allow_methods"`
+	AllowHeaders     []string `json:"allow_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// MaxAge is how long browsers may cache a preflight answer, 0 leaves it to them
+	MaxAge Duration `json:"max_age"`
+}
+
+// TLSConfig holds the listener certificate and SNI based pool routing
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// SNIPools maps TLS server names to backend pools, "*.example.com"
+	// matches any single label subdomain
+	SNIPools map[string]string `json:"sni_pools"`
+	// ClientAuth asks clients for a certificate: "none" (the default),
+	// "request" without verifying it, "verify-if-given" or "require", the
+	// last two verify it against the CAs in ClientCAFile
+	ClientAuth   string `json:"client_auth"`
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// ForwardClientCertConfig describes the header telling backends about the
+// client's certificate, Fields are the XFCC fields to include: hash,
+// subject, uri and dns, all by default
+type ForwardClientCertConfig struct {
+	Header string   `json:"header"`
+	Fields []string `json:"fields"`
+}
+
+// BackendConfig describes a single backend server
+type BackendConfig struct {
+	URL    string            `json:"url"`
+	Labels map[string]string `json:"labels"`
+	// Pool is the named pool the backend belongs to, empty is the default pool
+	Pool string `json:"pool"`
+	// MaxConns caps the concurrent requests sent to the backend, 0 is no limit
+	MaxConns int64 `json:"max_conns"`
+	// MaxRate is how many requests a second the backend gets at most, the
+	// rest wait in a queue of RateQueue requests, 10 by default, for up to
+	// RateQueueTimeout, 1s by default, and are answered with 503 if the
+	// queue is full or their turn is further off. 0 is no limit.
+	MaxRate          float64  `json:"max_rate"`
+	RateQueue        int      `json:"rate_queue"`
+	RateQueueTimeout Duration `json:"rate_queue_timeout"`
+	// Weight is the backend's share of traffic for weighted strategies, defaults to 1
+	Weight *int `json:"weight"`
+	// TLSServerName is the name sent in the TLS handshake and checked against
+	// the backend's certificate when it differs from the URL's host
+	TLSServerName string `json:"tls_server_name"`
+	// RequestTimeout overrides the global request_timeout for this backend
+	RequestTimeout Duration `json:"request_timeout"`
+	// HealthCheckInterval overrides the global health_check_interval for this backend
+	HealthCheckInterval Duration `json:"health_check_interval"`
+	// HealthCheckConnectTimeout and HealthCheckReadTimeout override the
+	// global settings of the same names for this backend
+	HealthCheckConnectTimeout Duration `json:"health_check_connect_timeout"`
+	HealthCheckReadTimeout    Duration `json:"health_check_read_timeout"`
+	// HealthCheckURL is where the backend is probed when that isn't URL,
+	// such as a management port, http probes append their path to it
+	HealthCheckURL string `json:"health_check_url"`
+	// DisableKeepAlives opens a new connection for every request, for
+	// backends that mishandle reused connections
+	DisableKeepAlives bool `json:"disable_keep_alives"`
+}
+
+// PoolHealthConfig holds a pool's health check settings, see the global
+// settings of the same names
+type PoolHealthConfig struct {
+	Interval  Duration          `json:"interval"`
+	Checks    []ProbeConfig     `json:"checks"`
+	Policy    string            `json:"policy"`
+	Threshold float64           `json:"threshold"`
+	Headers   map[string]string `json:"headers"`
+}
+
+// ProbeConfig describes a health probe
+type ProbeConfig struct {
+	// Type is tcp, http or command
+	Type string `json:"type"`
+	// Path is the path an http probe requests, defaults to /healthz
+	Path string `json:"path"`
+	// VersionField is the field of an http probe's JSON response holding
+	// the backend's version, "a.b" is field b of the object in field a,
+	// the version is the backend's "version" label
+	VersionField string `json:"version_field"`
+	// Command is run by a command probe with the backend URL in LB_BACKEND_URL
+	Command []string `json:"command"`
+	// Weight counts under the weighted policy, defaults to 1
+	Weight  *float64 `json:"weight"`
+	Timeout Duration `json:"timeout"`
+}
+
+// StickyCookieConfig describes cookie based sticky sessions
+type StickyCookieConfig struct {
+	// Name is the cookie name, defaults to lb_backend
+	Name string `json:"name"`
+	// MaxAge is how long the cookie lasts, 0 makes it a session cookie
+	MaxAge Duration `json:"max_age"`
+	// Rebalance steers new sessions away from a backend holding more than
+	// this factor times its weight's share of the sessions, 0 disables it
+	Rebalance float64 `json:"rebalance"`
+	// SessionLifetime is how long a session is taken to last when counting
+	// the sessions each backend holds for rebalancing, defaults to MaxAge,
+	// or 30m for session cookies
+	SessionLifetime Duration `json:"session_lifetime"`
+}
+
+// PinConfig describes debug pinning of requests to a backend
+type PinConfig struct {
+	// Header carries the URL of the backend to pin to, defaults to X-LB-Backend
+	Header string `json:"header"`
+	// TrustedCIDRs are the client networks allowed to pin, defaults to loopback
+	TrustedCIDRs []string `json:"trusted_cidrs"`
+}
+
+// OverrideConfig describes the signed backend override, Header carries a
+// JWT signed with HS256 using Secret, defaults to X-LB-Override. Its claims
+// name a "backend" URL or a "pool" and must hold an "exp".
+type OverrideConfig struct {
+	Header string `json:"header"`
+	Secret string `json:"secret"`
+}
+
+// RequestCostConfig estimates a request's cost, in units where a typical
+// request costs 1. Header names a request header holding the cost, to be
+// set by a trusted proxy in front, it wins when it holds a positive
+// number and the request comes from TrustedCIDRs, loopback by default. It
+// is stripped before the request goes to the backend. Otherwise Paths
+// give the cost of the requests under a path prefix, the longest matching
+// prefix wins and requests matching none cost 1, and BytesPerUnit adds a
+// unit per that many bytes of Content-Length.
+type RequestCostConfig struct {
+	Header       string             `json:"header"`
+	TrustedCIDRs []string           `json:"trusted_cidrs"`
+	Paths        map[string]float64 `json:"paths"`
+	BytesPerUnit int64              `json:"bytes_per_unit"`
+}
+
+// DualWriteConfig describes the dual writes: requests with one of Methods,
+// POST, PUT, PATCH and DELETE by default, under PathPrefix are sent to the
+// Secondary too when the strategy sends them to the Primary backend and it
+// answers. Compare is "status",
+// the default, or "body" to compare the bodies as well, JSON ones without
+// IgnoreFields. Bodies over MaxBodyBytes, 1MB by default, aren't dual
+// written, the Secondary gets Timeout to answer, 10s by default.
+type DualWriteConfig struct {
+	Primary      string        `json:"primary"`
+	Secondary    BackendConfig `json:"secondary"`
+	Methods      []string      `json:"methods"`
+	PathPrefix   string        `json:"path_prefix"`
+	Compare      string        `json:"compare"`
+	IgnoreFields []string      `json:"ignore_fields"`
+	MaxBodyBytes int64         `json:"max_body_bytes"`
+	Timeout      Duration      `json:"timeout"`
+}
+
+// RewriteConfig describes the response body rewriting
+type RewriteConfig struct {
+	// ContentTypes are the media types rewritten, defaults to common text types
+	ContentTypes []string      `json:"content_types"`
+	Rules        []RewriteRule `json:"rules"`
+}
+
+// RewriteRule replaces every From in the body with To
+type RewriteRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// AutoWeightConfig bounds the weights set by auto weighting
+type AutoWeightConfig struct {
+	MinWeight int      `json:"min_weight"`
+	MaxWeight int      `json:"max_weight"`
+	Interval  Duration `json:"interval"`
+}
+
+// ProbeWeightConfig describes how probe latency lowers backend weights,
+// probes up to SlowThreshold get MaxWeight, from there the weight drops
+// linearly to MinWeight at MaxLatency
+type ProbeWeightConfig struct {
+	SlowThreshold Duration `json:"slow_threshold"`
+	MaxLatency    Duration `json:"max_latency"`
+	MinWeight     int      `json:"min_weight"`
+	MaxWeight     int      `json:"max_weight"`
+}
+
+// StrategyStepConfig is a step of a strategy chain, Zone restricts the
+// step to the backends labeled with that zone
+type StrategyStepConfig struct {
+	Strategy string `json:"strategy"`
+	HashKey  string `json:"hash_key"`
+	Zone     string `json:"zone"`
+}
+
+// RetryBackoffConfig describes the wait before a retry, Base doubles with
+// every retry up to Max, and Jitter is the fraction of the wait that is
+// randomized, 1 for full jitter
+type RetryBackoffConfig struct {
+	Base   Duration `json:"base"`
+	Max    Duration `json:"max"`
+	Jitter float64  `json:"jitter"`
+}
+
+// MaintenanceConfig describes the maintenance page, Dir holds its
+// index.html and the files it links under /_maintenance/, a built in page
+// is used without it. Enabled starts the load balancer in maintenance mode,
+// the admin API toggles it. MaxAge is how long clients may cache the
+// linked files, 5m by default.
+type MaintenanceConfig struct {
+	Dir     string   `json:"dir"`
+	Enabled bool     `json:"enabled"`
+	MaxAge  Duration `json:"max_age"`
+}
+
+// RetryBudgetConfig caps the retries over the last Window, 10s by default,
+// at Ratio of the requests, 0.1 by default. MinRetries are allowed whatever
+// the ratio, 10 by default, so pools with little traffic can still fail over.
+type RetryBudgetConfig struct {
+	Ratio      float64  `json:"ratio"`
+	Window     Duration `json:"window"`
+	MinRetries int      `json:"min_retries"`
+}
+
+// FailFastConfig describes when a backend counts as failing and how many
+// requests it still gets: Failures errors or 5xx responses in a row trip
+// it, then it gets ProbeRate requests per second, at most ProbeBurst at once
+type FailFastConfig struct {
+	Failures   int     `json:"failures"`
+	ProbeRate  float64 `json:"probe_rate"`
+	ProbeBurst int     `json:"probe_burst"`
+}
+
+// DistributionAuditConfig says how far a backend's share of its pool's
+// requests may drift from its weight share, windows with fewer than
+// MinRequests requests in the pool are too small to judge and skipped,
+// Correct scales the effective weights of drifting backends back toward
+// target for the next window, backends back within Threshold get their
+// configured weight again
+type DistributionAuditConfig struct {
+	Interval    Duration `json:"interval"`
+	Threshold   float64  `json:"threshold"`
+	MinRequests uint64   `json:"min_requests"`
+	Correct     bool     `json:"correct"`
+}
+
+// Duration is a time.Duration that is read from strings like "10s"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Version: configVersion,
+		Port:    8000,
+		Backends: []BackendConfig{
+			{URL: "http://localhost:8001"},
+			{URL: "http://localhost:8002"},
+			{URL: "http://localhost:8003"},
+			{URL: "http://localhost:8004"},
+			{URL: "http://localhost:8005"},
+		},
+		HealthCheckInterval:   Duration{10 * time.Second},
+		StatsWindow:           Duration{time.Minute},
+		MaxRetries:            2,
+		ErrorLogLimit:         10,
+		ErrorLogInterval:      Duration{time.Minute},
+		ReadHeaderTimeout:     Duration{10 * time.Second},
+		IdleTimeout:           Duration{120 * time.Second},
+		MaxHeaderBytes:        1 << 20,
+		ShutdownTimeout:       Duration{30 * time.Second},
+		StartupProbeInterval:  Duration{time.Second},
+		ExpectContinueTimeout: Duration{time.Second},
+		DialFallbackDelay:     Duration{300 * time.Millisecond},
+		Strategy:              "round-robin",
+		LoadHeader:            "X-Backend-Load",
+		DrainHeader:           "X-Drain",
+	}
+}
+
+// LoadConfig reads a JSON config file on top of the defaults
+func LoadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = migrateConfig(data); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// migrateConfig brings a config file up to the current schema version
+func migrateConfig(data []byte) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	version := 1
+	if v, ok := raw["version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return nil, fmt.Errorf("version: %w", err)
+		}
+	}
+	if version < 1 || version > configVersion {
+		return nil, fmt.Errorf("unknown version %d, this build reads versions 1 to %d", version, configVersion)
+	}
+	if version == configVersion {
+		return data, nil
+	}
+	for _, migrate := range configMigrations[version-1:] {
+		if err := migrate(raw); err != nil {
+			return nil, fmt.Errorf("migrate from version %d: %w", version, err)
+		}
+		version++
+	}
+	raw["version"], _ = json.Marshal(version)
+	return json.Marshal(raw)
+}
+
+// LoadConfigFromEnv overrides cfg with the settings found in the environment,
+// the precedence is defaults, then the config file, then the environment:
+//
+//	LB_PORT                  port
+//	LB_ADMIN_PORT            admin_port
+//	LB_BACKENDS              backends, as comma separated URLs
+//	LB_HEALTHCHECK_INTERVAL  health_check_interval
+//	LB_STRATEGY              strategy
+func LoadConfigFromEnv(cfg *Config) error {
+	if v, ok := os.LookupEnv("LB_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("LB_PORT: %w", err)
+		}
+		cfg.Port = port
+	}
+	if v, ok := os.LookupEnv("LB_ADMIN_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("LB_ADMIN_PORT: %w", err)
+		}
+		cfg.AdminPort = port
+	}
+	if v, ok := os.LookupEnv("LB_BACKENDS"); ok {
+		cfg.Backends = nil
+		for _, u := range strings.Split(v, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				cfg.Backends = append(cfg.Backends, BackendConfig{URL: u})
+			}
+		}
+	}
+	if v, ok := os.LookupEnv("LB_HEALTHCHECK_INTERVAL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("LB_HEALTHCHECK_INTERVAL: %w", err)
+		}
+		cfg.HealthCheckInterval.Duration = d
+	}
+	if v, ok := os.LookupEnv("LB_STRATEGY"); ok {
+		cfg.Strategy = v
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("environment: %w", err)
+	}
+	return nil
+}
+
+// dedupBackends finds backends listed more than once and rejects or
+// merges them by the duplicate_backends policy, merging keeps the first
+// entry's settings, duplicates in different pools are always rejected
+func (cfg *Config) dedupBackends() error {
+	switch cfg.DuplicateBackends {
+	case "", "reject", "merge":
+	default:
+		return fmt.Errorf("unknown duplicate_backends %q", cfg.DuplicateBackends)
+	}
+	seen := make(map[string]int)
+	var backends []BackendConfig
+	for _, bc := range cfg.Backends {
+		u, err := url.Parse(bc.URL)
+		if err != nil {
+			return fmt.Errorf("backend %s: %w", bc.URL, err)
+		}
+		key := stateKey(u)
+		i, dup := seen[key]
+		if !dup {
+			seen[key] = len(backends)
+			backends = append(backends, bc)
+			continue
+		}
+		first := &backends[i]
+		if cfg.DuplicateBackends != "merge" {
+			return fmt.Errorf("backend %s is listed twice, also as %s", bc.URL, first.URL)
+		}
+		if bc.Pool != first.Pool {
+			return fmt.Errorf("backend %s is listed in pools %q and %q", bc.URL, first.Pool, bc.Pool)
+		}
+		w := backendWeight(*first) + backendWeight(bc)
+		first.Weight = &w
+	}
+	cfg.Backends = backends
+	return nil
+}
+
+// validateBackend checks the settings of a backend, those in the config
+// and those added through the admin API alike
+func validateBackend(bc BackendConfig) error {
+	if bc.HealthCheckInterval.Duration < 0 {
+		return fmt.Errorf("backend %s: negative health_check_interval", bc.URL)
+	}
+	if bc.MaxRate < 0 || bc.RateQueue < 0 || bc.RateQueueTimeout.Duration < 0 {
+		return fmt.Errorf("backend %s: negative rate setting", bc.URL)
+	}
+	if bc.HealthCheckConnectTimeout.Duration < 0 || bc.HealthCheckReadTimeout.Duration < 0 {
+		return fmt.Errorf("backend %s: negative health check timeout", bc.URL)
+	}
+	if bc.HealthCheckURL != "" {
+		if u, err := url.Parse(bc.HealthCheckURL); err != nil || u.Host == "" {
+			return fmt.Errorf("backend %s: invalid health_check_url %q", bc.URL, bc.HealthCheckURL)
+		}
+	}
+	return nil
+}
+
+// backendWeight is the backend's configured weight, 1 if unset
+func backendWeight(bc BackendConfig) int {
+	if bc.Weight == nil {
+		return 1
+	}
+	return *bc.Weight
+}
+
+func validateHealthPolicy(policy string, threshold float64) error {
+	switch policy {
+	case "", "all", "any":
+	case "weighted":
+		if threshold <= 0 || threshold > 1 {
+			return fmt.Errorf("weighted health_policy needs 0 < health_threshold <= 1")
+		}
+	default:
+		return fmt.Errorf("unknown health_policy %q", policy)
+	}
+	return nil
+}
+
+// validate checks the settings and fills in the ones left to be derived
+func (cfg *Config) validate() error {
+	if len(cfg.Backends) == 0 {
+		return fmt.Errorf("no backends")
+	}
+	if err := cfg.dedupBackends(); err != nil {
+		return err
+	}
+	switch cfg.RequestID {
+	case "", "x-request-id", "traceparent":
+	default:
+		return fmt.Errorf("unknown request_id %q", cfg.RequestID)
+	}
+	if len(cfg.RedirectHosts) > 0 {
+		hosts := make(map[string]string, len(cfg.RedirectHosts))
+		for host, public := range cfg.RedirectHosts {
+			if u, err := url.Parse(public); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("redirect_hosts %q: invalid url %q", host, public)
+			}
+			hosts[strings.ToLower(host)] = public
+		}
+		cfg.RedirectHosts = hosts
+	}
+	if cfg.SelfTestPath == "" {
+		cfg.SelfTestPath = "/"
+	}
+	if !strings.HasPrefix(cfg.SelfTestPath, "/") {
+		return fmt.Errorf("self_test_path must start with /")
+	}
+	if cfg.ErrorRateAlert < 0 || cfg.ErrorRateAlert > 1 {
+		return fmt.Errorf("error_rate_alert must be between 0 and 1")
+	}
+	if wh := cfg.Webhook; wh != nil {
+		if u, err := url.Parse(wh.URL); err != nil || u.Host == "" {
+			return fmt.Errorf("webhook: invalid url %q", wh.URL)
+		}
+		if wh.QueueSize < 0 || wh.MaxRetries < 0 || wh.Timeout.Duration < 0 {
+			return fmt.Errorf("webhook settings must not be negative")
+		}
+		if wh.QueueSize == 0 {
+			wh.QueueSize = 100
+		}
+		if wh.MaxRetries == 0 {
+			wh.MaxRetries = 3
+		}
+		if wh.Timeout.Duration == 0 {
+			wh.Timeout.Duration = 5 * time.Second
+		}
+	}
+	if ac := cfg.AdaptiveConcurrency; ac != nil {
+		if ac.InitialLimit == 0 {
+			ac.InitialLimit = 20
+		}
+		if ac.MinLimit == 0 {
+			ac.MinLimit = 1
+		}
+		if ac.MaxLimit == 0 {
+			ac.MaxLimit = 1000
+		}
+		if ac.MinLimit < 1 || ac.MinLimit > ac.InitialLimit || ac.InitialLimit > ac.MaxLimit {
+			return fmt.Errorf("adaptive_concurrency needs 1 <= min_limit <= initial_limit <= max_limit")
+		}
+	}
+	if st := cfg.StaleIfError; st != nil {
+		if st.MaxStale.Duration < 0 || st.MaxEntries < 0 || st.MaxBodyBytes < 0 {
+			return fmt.Errorf("stale_if_error settings must not be negative")
+		}
+		if st.MaxEntries == 0 {
+			st.MaxEntries = 1000
+		}
+		if st.MaxBodyBytes == 0 {
+			st.MaxBodyBytes = 1 << 20
+		}
+		switch st.Head {
+		case "":
+			st.Head = headStale
+		case headOff, headStale, headFresh:
+		default:
+			return fmt.Errorf("stale_if_error head must be off, stale or fresh")
+		}
+	}
+	if rc := cfg.RequestCost; rc != nil {
+		if rc.BytesPerUnit < 0 {
+			return fmt.Errorf("request_cost bytes_per_unit must not be negative")
+		}
+		for prefix, c := range rc.Paths {
+			if !(c > 0) {
+				return fmt.Errorf("request_cost of path %s must be positive", prefix)
+			}
+		}
+	}
+	if dw := cfg.DualWrite; dw != nil {
+		if dw.Primary == "" || dw.Secondary.URL == "" {
+			return fmt.Errorf("dual_write needs a primary and a secondary")
+		}
+		if dw.MaxBodyBytes < 0 || dw.Timeout.Duration < 0 {
+			return fmt.Errorf("dual_write settings must not be negative")
+		}
+		if len(dw.Methods) == 0 {
+			dw.Methods = []string{"POST", "PUT", "PATCH", "DELETE"}
+		}
+		switch dw.Compare {
+		case "":
+			dw.Compare = compareStatus
+		case compareStatus, compareBody:
+		default:
+			return fmt.Errorf("dual_write compare must be status or body")
+		}
+		if dw.MaxBodyBytes == 0 {
+			dw.MaxBodyBytes = 1 << 20
+		}
+		if dw.Timeout.Duration == 0 {
+			dw.Timeout.Duration = 10 * time.Second
+		}
+	}
+	if cfg.Override != nil && len(cfg.Override.Secret) < 32 {
+		return fmt.Errorf("override secret must be at least 32 bytes")
+	}
+	if mc := cfg.Maintenance; mc != nil {
+		if mc.MaxAge.Duration < 0 {
+			return fmt.Errorf("maintenance max_age must not be negative")
+		}
+		if mc.MaxAge.Duration == 0 {
+			mc.MaxAge.Duration = 5 * time.Minute
+		}
+	}
+	if rb := cfg.RetryBudget; rb != nil {
+		if rb.Ratio < 0 || rb.Window.Duration < 0 || rb.MinRetries < 0 {
+			return fmt.Errorf("retry_budget settings must not be negative")
+		}
+		if rb.Ratio == 0 {
+			rb.Ratio = 0.1
+		}
+		if rb.Window.Duration == 0 {
+			rb.Window.Duration = 10 * time.Second
+		}
+		if rb.MinRetries == 0 {
+			rb.MinRetries = 10
+		}
+	}
+	if g := cfg.GeoIP; g != nil {
+		if g.Database == "" {
+			return fmt.Errorf("geoip needs a database")
+		}
+		if len(g.Countries) == 0 && len(g.Continents) == 0 {
+			return fmt.Errorf("geoip needs countries or continents mapped to regions")
+		}
+	}
+	if cfg.MinBodyRate < 0 || cfg.MinBodyRateGrace.Duration < 0 {
+		return fmt.Errorf("min_body_rate settings must not be negative")
+	}
+	if cfg.MinBodyRate > 0 && cfg.MinBodyRateGrace.Duration == 0 {
+		cfg.MinBodyRateGrace.Duration = 5 * time.Second
+	}
+	if cfg.MaxInFlight < 0 {
+		return fmt.Errorf("max_in_flight must not be negative")
+	}
+	if cfg.HealthCheckConnectTimeout.Duration < 0 || cfg.HealthCheckReadTimeout.Duration < 0 {
+		return fmt.Errorf("health check timeouts must not be negative")
+	}
+	if cfg.HealthCheckInterval.Duration <= 0 {
+		return fmt.Errorf("health_check_interval must be positive")
+	}
+	for _, bc := range cfg.Backends {
+		if err := validateBackend(bc); err != nil {
+			return err
+		}
+	}
+	if fc := cfg.ForwardClientCert; fc != nil {
+		if fc.Header == "" {
+			fc.Header = "X-Forwarded-Client-Cert"
+		}
+		for _, f := range fc.Fields {
+			switch f {
+			case "hash", "subject", "uri", "dns":
+			default:
+				return fmt.Errorf("unknown forward_client_cert field %q", f)
+			}
+		}
+	}
+	if rb := cfg.RetryBackoff; rb != nil {
+		if rb.Base.Duration <= 0 || rb.Max.Duration < rb.Base.Duration {
+			return fmt.Errorf("retry_backoff needs 0 < base <= max")
+		}
+		if rb.Jitter < 0 || rb.Jitter > 1 {
+			return fmt.Errorf("retry_backoff jitter must be between 0 and 1")
+		}
+	}
+	if ff := cfg.FailFast; ff != nil {
+		if ff.Failures <= 0 {
+			ff.Failures = 5
+		}
+		if ff.ProbeRate <= 0 {
+			ff.ProbeRate = 1
+		}
+		if ff.ProbeBurst <= 0 {
+			ff.ProbeBurst = 1
+		}
+	}
+	if cfg.DegradedThreshold < 0 || cfg.DegradedThreshold > 1 {
+		return fmt.Errorf("degraded_threshold must be between 0 and 1")
+	}
+	for _, f := range cfg.AccessLogFields {
+		if _, ok := accessLogFields[f]; !ok {
+			return fmt.Errorf("unknown access_log_fields entry %q", f)
+		}
+	}
+	if cfg.InstanceName == "" {
+		cfg.InstanceName, _ = os.Hostname()
+	}
+	if cfg.StartupGracePeriod.Duration > 0 && cfg.StartupProbeInterval.Duration <= 0 {
+		return fmt.Errorf("startup_probe_interval must be positive")
+	}
+	if cfg.ErrorLogInterval.Duration <= 0 {
+		return fmt.Errorf("error_log_interval must be positive")
+	}
+	if cfg.StatsWindow.Duration <= 0 {
+		return fmt.Errorf("stats_window must be positive")
+	}
+	switch cfg.TrailingSlash {
+	case "", "keep", "strip", "add":
+	default:
+		return fmt.Errorf("unknown trailing_slash %q", cfg.TrailingSlash)
+	}
+	if err := validateHealthPolicy(cfg.HealthPolicy, cfg.HealthThreshold); err != nil {
+		return err
+	}
+	for name, ph := range cfg.PoolHealth {
+		if ph.Interval.Duration < 0 {
+			return fmt.Errorf("pool_health %q: negative interval", name)
+		}
+		if err := validateHealthPolicy(ph.Policy, ph.Threshold); err != nil {
+			return fmt.Errorf("pool_health %q: %w", name, err)
+		}
+	}
+	if cfg.ExpectContinueTimeout.Duration <= 0 {
+		return fmt.Errorf("expect_continue_timeout must be positive")
+	}
+	if rw := cfg.Rewrite; rw != nil {
+		if len(rw.Rules) == 0 {
+			return fmt.Errorf("rewrite has no rules")
+		}
+		for _, rule := range rw.Rules {
+			if rule.From == "" {
+				return fmt.Errorf("rewrite rule with empty from")
+			}
+		}
+	}
+	if sc := cfg.StickyCookie; sc != nil {
+		if sc.Rebalance != 0 && sc.Rebalance < 1 {
+			return fmt.Errorf("sticky_cookie rebalance must be 0 or at least 1")
+		}
+		if sc.SessionLifetime.Duration < 0 {
+			return fmt.Errorf("sticky_cookie session_lifetime must not be negative")
+		}
+		if sc.SessionLifetime.Duration == 0 {
+			sc.SessionLifetime.Duration = cmp.Or(sc.MaxAge.Duration, 30*time.Minute)
+		}
+	}
+	if pw := cfg.ProbeWeight; pw != nil {
+		if cfg.AutoWeight != nil {
+			return fmt.Errorf("auto_weight and probe_weight both set weights, pick one")
+		}
+		if pw.MinWeight < 1 || pw.MaxWeight < pw.MinWeight {
+			return fmt.Errorf("probe_weight needs 1 <= min_weight <= max_weight")
+		}
+		if pw.MaxLatency.Duration <= pw.SlowThreshold.Duration {
+			return fmt.Errorf("probe_weight needs slow_threshold < max_latency")
+		}
+	}
+	if da := cfg.DistributionAudit; da != nil {
+		if cfg.Strategy != "weighted-round-robin" || len(cfg.StrategyChain) > 0 {
+			return fmt.Errorf("distribution_audit needs the weighted-round-robin strategy")
+		}
+		if da.Threshold <= 0 || da.Threshold >= 1 {
+			return fmt.Errorf("distribution_audit needs 0 < threshold < 1")
+		}
+		if da.Interval.Duration <= 0 {
+			da.Interval.Duration = time.Minute
+		}
+	}
+	if aw := cfg.AutoWeight; aw != nil {
+		if aw.MinWeight < 1 || aw.MaxWeight < aw.MinWeight {
+			return fmt.Errorf("auto_weight needs 1 <= min_weight <= max_weight")
+		}
+		if aw.Interval.Duration <= 0 {
+			aw.Interval.Duration = 30 * time.Second
+		}
+	}
+	return nil
+}
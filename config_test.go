@@ -0,0 +1,50 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDuplicateBackends(t *testing.T) {
+	weight := func(w int) *int { return &w }
+	for _, tc := range []struct {
+		name     string
+		policy   string
+		backends []BackendConfig
+		wantErr  bool
+		want     []int // weights of the backends left
+	}{
+		{"distinct", "", []BackendConfig{{URL: "http://a.example"}, {URL: "http://b.example"}}, false, []int{1, 1}},
+		{"rejected", "", []BackendConfig{{URL: "http://a.example"}, {URL: "http://A.example:80/"}}, true, nil},
+		{"other scheme", "", []BackendConfig{{URL: "http://a.example:443"}, {URL: "https://a.example"}}, false, []int{1, 1}},
+		{"merged", "merge", []BackendConfig{
+			{URL: "http://a.example", Weight: weight(2)},
+			{URL: "http://b.example"},
+			{URL: "http://a.example:80", Weight: weight(3)},
+		}, false, []int{5, 1}},
+		{"merged across pools", "merge", []BackendConfig{
+			{URL: "http://a.example"},
+			{URL: "http://a.example", Pool: "other"},
+		}, true, nil},
+		{"unknown policy", "drop", []BackendConfig{{URL: "http://a.example"}}, true, nil},
+	} {
+		cfg := defaultConfig()
+		cfg.DuplicateBackends = tc.policy
+		cfg.Backends = tc.backends
+		err := cfg.dedupBackends()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: error %v, want error %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got []int
+		for _, bc := range cfg.Backends {
+			got = append(got, backendWeight(bc))
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: weights %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultCORSMethods are the methods allowed when the CORS policy names none
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// handlesOptions reports whether the load balancer answers the request
+// itself rather than forwarding it, which it does for OPTIONS requests on
+// routes set to handle them
+func handlesOptions(r *http.Request, m *routeMatch) bool {
+	return r.Method == http.MethodOptions && m.route != nil && m.route.HandleOptions
+}
+
+// answerOptions answers an OPTIONS request with the methods allowed, a
+// CORS preflight also gets the CORS policy if the origin is allowed
+func (lb *LoadBalancer) answerOptions(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	methods := defaultCORSMethods
+	if cors := lb.cfg.CORS; cors != nil && len(cors.AllowMethods) > 0 {
+		methods = cors.AllowMethods
+	}
+	h.Set("Allow", strings.Join(append(slices.Clone(methods), http.MethodOptions), ", "))
+	if cors := lb.cfg.CORS; cors != nil && r.Header.Get("Access-Control-Request-Method") != "" {
+		if lb.allowOrigin(h, r) {
+			h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			headers := r.Header.Get("Access-Control-Request-Headers")
+			if len(cors.AllowHeaders) > 0 {
+				headers = strings.Join(cors.AllowHeaders, ", ")
+			}
+			if headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			if cors.MaxAge.Duration > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+			}
+		}
+	}
+	lb.setResponseHeaders(h, r, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowOrigin sets the headers allowing the request's origin if the CORS
+// policy allows it and reports whether it did, the answer depends on the
+// origin so caches are told to vary on it
+func (lb *LoadBalancer) allowOrigin(h http.Header, r *http.Request) bool {
+	cors := lb.cfg.CORS
+	if cors == nil {
+		return false
+	}
+	h.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !slices.Contains(cors.AllowOrigins, origin) && !slices.Contains(cors.AllowOrigins, "*") {
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if cors.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
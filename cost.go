@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RequestCost estimates what serving a request costs a backend, in units
+// where a typical request costs 1. Costs that aren't positive count as 1.
+type RequestCost func(*http.Request) float64
+
+// SetRequestCost makes the strategies balance the estimated cost of the
+// requests rather than their number, it must be called before the load
+// balancer serves requests
+func (lb *LoadBalancer) SetRequestCost(cost RequestCost) {
+	lb.requestCost = cost
+}
+
+type requestCostKey struct{}
+
+// withRequestCost puts the request's estimated cost in its context for
+// the strategies and the backend's cost accounting
+func (lb *LoadBalancer) withRequestCost(r *http.Request) *http.Request {
+	c := lb.requestCost(r)
+	if !(c > 0) || math.IsInf(c, 1) {
+		c = 1
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestCostKey{}, c))
+}
+
+// requestCostFrom returns the request's cost, false if costs aren't estimated
+func requestCostFrom(ctx context.Context) (float64, bool) {
+	c, ok := ctx.Value(requestCostKey{}).(float64)
+	return c, ok
+}
+
+// costMilli is the fixed point scale the backends count their cost in
+const costMilli = 1000
+
+func (b *Backend) addCost(c float64) {
+	b.activeCost.Add(int64(math.Round(c * costMilli)))
+}
+
+// ActiveCost is the estimated cost of the requests the backend is serving
+func (b *Backend) ActiveCost() float64 {
+	return float64(b.activeCost.Load()) / costMilli
+}
+
+// newRequestCost builds the cost estimate described by the config: the
+// header's value if it holds a positive number and the request comes from
+// a trusted network, otherwise the cost of the longest matching path
+// prefix, 1 if none matches, plus a unit per BytesPerUnit of Content-Length
+func newRequestCost(cfg *RequestCostConfig) (RequestCost, error) {
+	trusted, err := newTrustedNets(cfg.TrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return func(r *http.Request) float64 {
+		if cfg.Header != "" && trusted.allows(r) {
+			if c, err := strconv.ParseFloat(r.Header.Get(cfg.Header), 64); err == nil && c > 0 {
+				return c
+			}
+		}
+		c, longest := 1.0, -1
+		for prefix, pc := range cfg.Paths {
+			if len(prefix) > longest && strings.HasPrefix(r.URL.Path, prefix) {
+				c, longest = pc, len(prefix)
+			}
+		}
+		if cfg.BytesPerUnit > 0 && r.ContentLength > 0 {
+			c += float64(r.ContentLength) / float64(cfg.BytesPerUnit)
+		}
+		return c
+	}, nil
+}
+
+// costCredits balances the cost of the requests between backends, every
+// pick credits each backend with the request's cost times its weight and
+// debits the picked one the cost times the total weight. A backend falls
+// behind after an expensive request and catches up while the others take
+// cheap ones. With every request costing 1 it is the smooth weighted
+// round-robin.
+type costCredits map[*Backend]float64
+
+// pick returns the backend with the most credit among those weight gives
+// a positive weight, nil if there is none
+func (cc costCredits) pick(backends []*Backend, cost float64, weight func(*Backend) float64) *Backend {
+	var best *Backend
+	total := 0.0
+	for _, b := range backends {
+		w := weight(b)
+		if w <= 0 {
+			continue
+		}
+		cc[b] += w * cost
+		total += w
+		if best == nil || cc[b] > cc[best] {
+			best = b
+		}
+	}
+	if best != nil {
+		cc[best] -= total * cost
+	}
+	return best
+}
+
+// prune drops the credit of the backends keep doesn't hold
+func (cc costCredits) prune(keep map[*Backend]bool) {
+	for b := range cc {
+		if !keep[b] {
+			delete(cc, b)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestCostHeaderOnlyFromTrustedClients(t *testing.T) {
+	cost, err := newRequestCost(&RequestCostConfig{Header: "X-Cost", Paths: map[string]float64{"/report": 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remote string
+		want   float64
+	}{
+		{"127.0.0.1:1234", 50},
+		{"192.0.2.1:1234", 5},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/report", nil)
+		r.RemoteAddr = tc.remote
+		r.Header.Set("X-Cost", "50")
+		if c := cost(r); c != tc.want {
+			t.Errorf("from %s: cost %v, want %v", tc.remote, c, tc.want)
+		}
+	}
+}
+
+func TestRequestCostHeaderIsStripped(t *testing.T) {
+	var seen atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen.Store(r.Header.Get("X-Cost"))
+	}))
+	defer backend.Close()
+	lb := newTestLoadBalancer(t, []string{backend.URL}, func(cfg *Config) {
+		cfg.RequestCost = &RequestCostConfig{Header: "X-Cost"}
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Cost", "3")
+	if rec := do(lb, r); rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	if v := seen.Load(); v != "" {
+		t.Errorf("backend got X-Cost %q", v)
+	}
+}
+
+func TestRoundRobinForgetsRemovedBackends(t *testing.T) {
+	lb := newTestLoadBalancer(t, []string{"http://a.example", "http://b.example"}, func(cfg *Config) {
+		cfg.RequestCost = &RequestCostConfig{}
+	})
+	rr := lb.strategy.(*roundRobin)
+	r := lb.withRequestCost(httptest.NewRequest(http.MethodGet, "/", nil))
+	for range 4 {
+		lb.strategy.Next(lb.Backends(), r)
+	}
+	if err := lb.RemoveBackendGraceful("http://a.example", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(rr.credits) != 1 {
+		t.Errorf("credit kept for %d backends, want 1", len(rr.credits))
+	}
+}
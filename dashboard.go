@@ -0,0 +1,29 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+//go:embed templates/dashboard.html
+var templates embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(templates, "templates/dashboard.html"))
+
+// dashboardRefresh is how often the dashboard page reloads itself, in seconds
+const dashboardRefresh = 5
+
+// handleDashboard renders the backend stats as an HTML page
+func (lb *LoadBalancer) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Refresh int
+		Stats   Stats
+		Version VersionInfo
+	}{dashboardRefresh, lb.Stats(), buildVersion()}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// degradedPools tracks which pools have fewer alive backends than the
+// degraded threshold asks for, so crossing it is reported once each way
+type degradedPools struct {
+	mu    sync.Mutex
+	pools map[string]bool
+}
+
+// checkDegraded compares each pool's alive backends against the degraded
+// threshold and logs the pools crossing it in either direction
+func (lb *LoadBalancer) checkDegraded() {
+	threshold := lb.cfg.DegradedThreshold
+	if threshold <= 0 {
+		return
+	}
+	lb.mu.RLock()
+	pools := maps.Clone(lb.pools)
+	lb.mu.RUnlock()
+
+	lb.degraded.mu.Lock()
+	defer lb.degraded.mu.Unlock()
+	for name, backends := range pools {
+		alive := aliveCount(backends)
+		degraded := float64(alive) < threshold*float64(len(backends))
+		if degraded == lb.degraded.pools[name] {
+			continue
+		}
+		lb.degraded.pools[name] = degraded
+		if degraded {
+			fmt.Printf("WARNING: pool %q degraded, %d of %d backends alive, below %.0f%%\n", name, alive, len(backends), threshold*100)
+			lb.emit(EventPoolDegraded, "", name, "%d of %d backends alive, below %.0f%%", alive, len(backends), threshold*100)
+		} else {
+			fmt.Printf("pool %q recovered, %d of %d backends alive\n", name, alive, len(backends))
+			lb.emit(EventPoolRecovered, "", name, "%d of %d backends alive", alive, len(backends))
+		}
+	}
+}
+
+func aliveCount(backends []*Backend) int {
+	n := 0
+	for _, b := range backends {
+		if b.IsAlive() {
+			n++
+		}
+	}
+	return n
+}
+
+// poolStats returns the alive backends of every pool sorted by pool name
+func (lb *LoadBalancer) poolStats() []PoolStats {
+	lb.mu.RLock()
+	pools := maps.Clone(lb.pools)
+	lb.mu.RUnlock()
+	lb.degraded.mu.Lock()
+	defer lb.degraded.mu.Unlock()
+	stats := make([]PoolStats, 0, len(pools))
+	for name, backends := range pools {
+		stats = append(stats, PoolStats{
+			Name:     name,
+			Backends: len(backends),
+			Alive:    aliveCount(backends),
+			Degraded: lb.degraded.pools[name],
+		})
+	}
+	slices.SortFunc(stats, func(a, b PoolStats) int { return strings.Compare(a.Name, b.Name) })
+	return stats
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	compareStatus = "status"
+	compareBody   = "body"
+)
+
+// dualWrite sends the write requests the primary backend gets to a
+// secondary as well, so a backend being migrated to can be checked against
+// the one it replaces. The client always gets the primary's answer, the
+// secondary's is only compared with it and dropped.
+type dualWrite struct {
+	primary   *Backend
+	secondary *Backend
+	methods   []string
+	prefix    string
+	maxBody   int64
+	timeout   time.Duration
+	compare   func(p, s *responseRecorder) string
+
+	compared   atomic.Uint64
+	mismatched atomic.Uint64
+}
+
+func (lb *LoadBalancer) newDualWrite(cfg *DualWriteConfig) (*dualWrite, error) {
+	primary := lb.backendByURL(cfg.Primary)
+	if primary == nil {
+		return nil, fmt.Errorf("dual write primary %s is not a backend", cfg.Primary)
+	}
+	secondary, err := lb.newBackend(cfg.Secondary)
+	if err != nil {
+		return nil, fmt.Errorf("dual write secondary: %w", err)
+	}
+	secondary.SetAlive(true)
+	d := &dualWrite{
+		primary:   primary,
+		secondary: secondary,
+		methods:   cfg.Methods,
+		prefix:    cfg.PathPrefix,
+		maxBody:   cfg.MaxBodyBytes,
+		timeout:   cfg.Timeout.Duration,
+		compare:   compareStatuses,
+	}
+	if cfg.Compare == compareBody {
+		ignore := cfg.IgnoreFields
+		d.compare = func(p, s *responseRecorder) string {
+			if diff := compareStatuses(p, s); diff != "" {
+				return diff
+			}
+			return compareBodies(p, s, ignore, d.maxBody)
+		}
+	}
+	return d, nil
+}
+
+// prepare buffers the body of a write the primary could be picked for,
+// the request is dual written if it is. It returns false for requests that
+// aren't dual written, those with a body over the size limit included,
+// the request then goes on as it came.
+func (d *dualWrite) prepare(r *http.Request, pool []*Backend) ([]byte, bool) {
+	if !slices.Contains(d.methods, r.Method) || !strings.HasPrefix(r.URL.Path, d.prefix) ||
+		!slices.Contains(pool, d.primary) {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, d.maxBody+1))
+	if err != nil || int64(len(body)) > d.maxBody {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// forward sends the request to the primary, which must have been
+// acquired, as lb.forward does. Once the primary has answered the client
+// the request goes to the secondary in the background and the answers are
+// compared, a request the primary failed to take isn't.
+func (d *dualWrite) forward(lb *LoadBalancer, w http.ResponseWriter, r *http.Request, a *attempt, body []byte) bool {
+	tee := &teeWriter{ResponseWriter: w, rec: newResponseRecorder(), limit: d.maxBody}
+	if !lb.forward(d.primary, tee, r, a) {
+		return false
+	}
+
+	// the secondary's request has a context of its own, it mustn't be
+	// canceled with the client's or show up as the one that served it
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	r2 := r.Clone(ctx)
+	r2.Body = io.NopCloser(bytes.NewReader(body))
+	go func() {
+		defer cancel()
+		if !d.secondary.acquire() {
+			fmt.Printf("dual write %s %s: secondary %s is busy\n", r2.Method, r2.URL.Path, d.secondary.URL)
+			return
+		}
+		rec := newResponseRecorder()
+		lb.forward(d.secondary, rec, r2, &attempt{})
+		d.compared.Add(1)
+		if diff := d.compare(tee.rec, rec); diff != "" {
+			d.mismatched.Add(1)
+			fmt.Printf("dual write %s %s: %s\n", r2.Method, r2.URL.Path, diff)
+		}
+	}()
+	return true
+}
+
+func compareStatuses(p, s *responseRecorder) string {
+	if p.status != s.status {
+		return fmt.Sprintf("status %d from the primary, %d from the secondary", p.status, s.status)
+	}
+	return ""
+}
+
+// compareBodies compares the bodies after normalizing them, JSON ones are
+// compared as values without the ignored fields, others byte for byte
+// with the surrounding white space trimmed. Bodies too large to have been
+// kept whole aren't compared.
+func compareBodies(p, s *responseRecorder, ignore []string, limit int64) string {
+	if int64(p.body.Len()) > limit || int64(s.body.Len()) > limit {
+		return ""
+	}
+	if !bytes.Equal(normalizeBody(p.body.Bytes(), ignore), normalizeBody(s.body.Bytes(), ignore)) {
+		return fmt.Sprintf("bodies differ, %d bytes from the primary, %d from the secondary", p.body.Len(), s.body.Len())
+	}
+	return ""
+}
+
+func normalizeBody(b []byte, ignore []string) []byte {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return bytes.TrimSpace(b)
+	}
+	dropFields(v, ignore)
+	// maps are marshaled with sorted keys, the field order doesn't matter
+	norm, _ := json.Marshal(v)
+	return norm
+}
+
+// dropFields removes the ignored fields from every object in v
+func dropFields(v any, ignore []string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for _, f := range ignore {
+			delete(v, f)
+		}
+		for _, e := range v {
+			dropFields(e, ignore)
+		}
+	case []any:
+		for _, e := range v {
+			dropFields(e, ignore)
+		}
+	}
+}
+
+// teeWriter passes a response on while keeping its status and up to limit
+// bytes of its body, one byte past the limit tells a body was cut short
+type teeWriter struct {
+	http.ResponseWriter
+	rec   *responseRecorder
+	limit int64
+}
+
+func (t *teeWriter) WriteHeader(status int) {
+	t.rec.WriteHeader(status)
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	if t.rec.status == 0 {
+		t.rec.status = http.StatusOK
+	}
+	if room := t.limit + 1 - int64(t.rec.body.Len()); room > 0 {
+		t.rec.body.Write(p[:min(int64(len(p)), room)])
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+func (t *teeWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
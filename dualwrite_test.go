@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoBackend answers with the request body in a JSON document holding
+// id as well, and counts the requests it gets
+func echoBackend(t *testing.T, id string, n *atomic.Int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"` + id + `","echo":"` + string(body) + `"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDualWriteFollowsTheStrategy(t *testing.T) {
+	var primaryN, otherN, secondaryN atomic.Int64
+	primary := echoBackend(t, "primary", &primaryN)
+	other := echoBackend(t, "other", &otherN)
+	secondary := echoBackend(t, "secondary", &secondaryN)
+	lb := newTestLoadBalancer(t, []string{primary.URL, other.URL}, func(cfg *Config) {
+		cfg.DualWrite = &DualWriteConfig{
+			Primary:      primary.URL,
+			Secondary:    BackendConfig{URL: secondary.URL},
+			Compare:      compareBody,
+			IgnoreFields: []string{"id"},
+		}
+	})
+
+	for range 4 {
+		rec := do(lb, httptest.NewRequest(http.MethodPost, "/items", strings.NewReader("x")))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", rec.Code)
+		}
+	}
+	if primaryN.Load() != 2 || otherN.Load() != 2 {
+		t.Fatalf("primary got %d and other %d requests, want round-robin", primaryN.Load(), otherN.Load())
+	}
+	waitFor(t, func() bool { return lb.Stats().DualWrites == 2 })
+	if n := secondaryN.Load(); n != 2 {
+		t.Fatalf("secondary got %d requests, want those the primary got", n)
+	}
+	if n := lb.Stats().DualWriteMismatches; n != 0 {
+		t.Fatalf("%d mismatches, want none with the ids ignored", n)
+	}
+
+	// reads aren't dual written
+	do(lb, httptest.NewRequest(http.MethodGet, "/items", nil))
+	do(lb, httptest.NewRequest(http.MethodGet, "/items", nil))
+
+	// a draining primary gets no new writes, so neither does the secondary
+	lb.backendByURL(primary.URL).Drain()
+	for range 2 {
+		do(lb, httptest.NewRequest(http.MethodPost, "/items", strings.NewReader("x")))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := secondaryN.Load(); n != 2 {
+		t.Fatalf("secondary got %d requests, want 2", n)
+	}
+}
+
+func TestDualWriteReportsMismatches(t *testing.T) {
+	var primaryN, secondaryN atomic.Int64
+	primary := echoBackend(t, "primary", &primaryN)
+	secondary := echoBackend(t, "secondary", &secondaryN)
+	lb := newTestLoadBalancer(t, []string{primary.URL}, func(cfg *Config) {
+		cfg.DualWrite = &DualWriteConfig{Primary: primary.URL, Secondary: BackendConfig{URL: secondary.URL}, Compare: compareBody}
+	})
+	rec := do(lb, httptest.NewRequest(http.MethodPut, "/items/1", strings.NewReader("x")))
+	if got := rec.Body.String(); got != `{"id":"primary","echo":"x"}` {
+		t.Fatalf("client got %s, want the primary's answer", got)
+	}
+	waitFor(t, func() bool { return lb.Stats().DualWriteMismatches == 1 })
+}
+
+func TestNormalizeBody(t *testing.T) {
+	a := normalizeBody([]byte(`{"b":1,"a":{"ts":1,"x":[{"ts":2,"y":3}]}}`), []string{"ts"})
+	b := normalizeBody([]byte(` {"a":{"x":[{"y":3}]},"b":1}`), []string{"ts"})
+	if string(a) != string(b) {
+		t.Fatalf("%s != %s", a, b)
+	}
+	if got := normalizeBody([]byte(" plain text\n"), nil); string(got) != "plain text" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errorLog prints request errors, at most limit lines for each backend and
+// kind of error per interval, the rest are counted and summed up in one
+// line when the interval ends
+type errorLog struct {
+	limit    int
+	interval time.Duration
+	mu       sync.Mutex
+	counts   map[errorLogKey]int
+}
+
+type errorLogKey struct {
+	backend string
+	kind    string
+}
+
+func newErrorLog(limit int, interval time.Duration) *errorLog {
+	return &errorLog{limit: limit, interval: interval, counts: make(map[errorLogKey]int)}
+}
+
+// log prints the backend's error unless its kind already hit the limit,
+// a limit of 0 or less prints everything
+func (l *errorLog) log(backend string, err error) {
+	if l.limit <= 0 {
+		fmt.Printf("server %s: %s\n", backend, err)
+		return
+	}
+	key := errorLogKey{backend, errorKind(err)}
+	l.mu.Lock()
+	l.counts[key]++
+	n := l.counts[key]
+	l.mu.Unlock()
+	if n <= l.limit {
+		fmt.Printf("server %s: %s\n", backend, err)
+	}
+}
+
+// summarizePeriodically reports the suppressed errors every interval until ctx is done
+func (l *errorLog) summarizePeriodically(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.summarize()
+		}
+	}
+}
+
+func (l *errorLog) summarize() {
+	l.mu.Lock()
+	counts := l.counts
+	l.counts = make(map[errorLogKey]int)
+	l.mu.Unlock()
+	for key, n := range counts {
+		if n > l.limit {
+			fmt.Printf("server %s: %d occurrences of %s in the last %s, %d not logged\n", key.backend, n, key.kind, l.interval, n-l.limit)
+		}
+	}
+}
+
+// errorKind names the kind of error so repeats of it can be told apart from new ones
+func errorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "unexpected EOF"
+	case errors.Is(err, errSlowBody):
+		return "slow request body"
+	case errors.Is(err, errResponseTooLarge):
+		return "response too large"
+	case errors.Is(err, errShaperQueueFull), errors.Is(err, errShaperTimeout):
+		return "rate queue overflow"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op + " error"
+	}
+	return fmt.Sprintf("%T", err)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Event types
+const (
+	EventBackendUp     = "backend_up"
+	EventBackendDown   = "backend_down"
+	EventPoolDegraded  = "pool_degraded"
+	EventPoolRecovered = "pool_recovered"
+	EventHighErrorRate = "high_error_rate"
+)
+
+// errorRateMinRequests is how many requests a backend must get in a stats
+// window for its error rate to count
+const errorRateMinRequests = 20
+
+// Event is a change in the load balancer's state worth telling operators about
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Backend  string    `json:"backend,omitempty"`
+	Pool     string    `json:"pool,omitempty"`
+	Message  string    `json:"message"`
+}
+
+// OnEvent adds a handler called with every event, it must not block and
+// must be added before the load balancer starts
+func (lb *LoadBalancer) OnEvent(handlers ...func(Event)) {
+	lb.eventHandlers = append(lb.eventHandlers, handlers...)
+}
+
+func (lb *LoadBalancer) emit(typ, backend, pool, format string, args ...any) {
+	if len(lb.eventHandlers) == 0 {
+		return
+	}
+	e := Event{
+		Type:     typ,
+		Time:     time.Now(),
+		Instance: lb.cfg.InstanceName,
+		Backend:  backend,
+		Pool:     pool,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	for _, h := range lb.eventHandlers {
+		h(e)
+	}
+}
+
+// checkErrorRate emits an event when the share of the backend's requests
+// that failed in the last window crosses the alert threshold, and logs it
+// going back under. Only called by rollTrafficWindow.
+func (lb *LoadBalancer) checkErrorRate(b *Backend, requests uint64) {
+	failed := b.errors.Load() + b.responses[4].Load()
+	windowFailed := failed - b.windowFailed
+	b.windowFailed = failed
+	if requests < errorRateMinRequests {
+		return
+	}
+	rate := float64(windowFailed) / float64(requests)
+	high := rate > lb.cfg.ErrorRateAlert
+	if high == b.errorRateHigh {
+		return
+	}
+	b.errorRateHigh = high
+	if high {
+		fmt.Printf("WARNING: server %s failed %.0f%% of its requests\n", b.URL, rate*100)
+		lb.emit(EventHighErrorRate, b.URL.String(), b.Pool, "%.0f%% of %d requests failed in the last %s", rate*100, requests, lb.cfg.StatsWindow.Duration)
+	} else {
+		fmt.Printf("server %s error rate back to %.0f%%\n", b.URL, rate*100)
+	}
+}
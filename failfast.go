@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The states of a fail-fast budget seen as a circuit breaker: closed lets
+// every request through, open none and half-open lets the next probe request
+// through
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// failFastBudget limits the requests a failing backend gets. After enough
+// consecutive failures it trips and from then on only takes requests it
+// has a token for, tokens refill at a fixed rate up to a burst, so a
+// trickle of requests keeps probing the backend until one succeeds and
+// the budget resets
+type failFastBudget struct {
+	threshold int
+	rate      float64
+	burst     float64
+	mu        sync.Mutex
+	failures  int
+	tripped   bool
+	tokens    float64
+	last      time.Time
+	// trips counts the times the budget tripped since it was last reset
+	trips uint64
+	// forced is the state an operator pinned the breaker in, whatever
+	// the requests do, empty when it follows them
+	forced string
+}
+
+func newFailFastBudget(cfg *FailFastConfig) *failFastBudget {
+	return &failFastBudget{threshold: cfg.Failures, rate: cfg.ProbeRate, burst: float64(cfg.ProbeBurst)}
+}
+
+// refill adds the tokens earned since the last refill, mu must be held
+func (f *failFastBudget) refill(now time.Time) {
+	f.tokens = min(f.tokens+now.Sub(f.last).Seconds()*f.rate, f.burst)
+	f.last = now
+}
+
+// allows reports whether the backend could take a request now
+func (f *failFastBudget) allows() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.forced != "" {
+		return f.forced == breakerClosed
+	}
+	if !f.tripped {
+		return true
+	}
+	f.refill(time.Now())
+	return f.tokens >= 1
+}
+
+// take spends a token if the backend is failing, it fails when none is left
+func (f *failFastBudget) take() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.forced != "" {
+		return f.forced == breakerClosed
+	}
+	if !f.tripped {
+		return true
+	}
+	f.refill(time.Now())
+	if f.tokens < 1 {
+		return false
+	}
+	f.tokens--
+	return true
+}
+
+// record counts the outcome of a request, it returns whether the budget
+// tripped or reset because of it
+func (f *failFastBudget) record(ok bool) (changed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ok {
+		f.failures = 0
+		changed = f.tripped
+		f.tripped = false
+		return changed
+	}
+	f.failures++
+	if f.tripped || f.failures < f.threshold {
+		return false
+	}
+	f.tripped = true
+	f.trips++
+	f.tokens = 0
+	f.last = time.Now()
+	return true
+}
+
+func (f *failFastBudget) failing() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tripped
+}
+
+// state returns the breaker state the budget is in and whether an
+// operator forced it
+func (f *failFastBudget) state() (state string, forced bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.forced != "":
+		return f.forced, true
+	case !f.tripped:
+		return breakerClosed, false
+	}
+	f.refill(time.Now())
+	if f.tokens >= 1 {
+		return breakerHalfOpen, false
+	}
+	return breakerOpen, false
+}
+
+// force pins the breaker open or closed, an empty state hands it back to
+// the requests
+func (f *failFastBudget) force(state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forced = state
+}
+
+// reset forgets the failures and trips, the breaker closes unless forced
+func (f *failFastBudget) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = 0
+	f.trips = 0
+	f.tripped = false
+	f.tokens = 0
+}
+
+// counts returns the failures in a row and the trips since the last reset
+func (f *failFastBudget) counts() (failures int, trips uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failures, f.trips
+}
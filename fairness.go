@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// trafficSharePeriodically recomputes the traffic shares every window until ctx is done
+func (lb *LoadBalancer) trafficSharePeriodically(ctx context.Context, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lb.rollTrafficWindow()
+		}
+	}
+}
+
+// rollTrafficWindow sets each backend's share of the requests its pool
+// served since the previous call
+func (lb *LoadBalancer) rollTrafficWindow() {
+	backends := lb.Backends()
+	counts := make([]uint64, len(backends))
+	totals := make(map[string]uint64)
+	for i, b := range backends {
+		n := b.requests.Load()
+		counts[i] = n - b.windowStart
+		b.windowStart = n
+		totals[b.Pool] += counts[i]
+	}
+	for i, b := range backends {
+		b.reconcileConns(counts[i], lb.cfg.StatsWindow.Duration)
+		if lb.cfg.ErrorRateAlert > 0 {
+			lb.checkErrorRate(b, counts[i])
+		}
+		var share float64
+		if total := totals[b.Pool]; total > 0 {
+			share = float64(counts[i]) / float64(total)
+		}
+		b.setRequestShare(share)
+	}
+}
+
+// weightShares returns each backend's share of its pool's total weight,
+// which is the share of requests weighted strategies aim for
+func weightShares(stats []BackendStats) []float64 {
+	totals := make(map[string]int)
+	for _, s := range stats {
+		totals[s.Pool] += s.Weight
+	}
+	shares := make([]float64, len(stats))
+	for i, s := range stats {
+		if total := totals[s.Pool]; total > 0 {
+			shares[i] = float64(s.Weight) / float64(total)
+		}
+	}
+	return shares
+}
+
+// reconcileConns checks the backend's in-flight count against the requests
+// it got in the last window, a negative count is a bookkeeping bug and is
+// reset, requests in flight through a window without new ones are either
+// long-lived, like WebSockets, or leaked
+func (b *Backend) reconcileConns(requests uint64, window time.Duration) {
+	n := b.activeConns.Load()
+	switch {
+	case n < 0:
+		if b.activeConns.CompareAndSwap(n, 0) {
+			fmt.Printf("server %s: active connection count was %d, reset to 0\n", b.URL, n)
+		}
+	case n > 0 && requests == 0:
+		fmt.Printf("server %s: %d requests in flight but none started in the last %s, check for long-lived or leaked connections\n", b.URL, n, window)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+)
+
+// regionLabel is the backend label holding the region the backend runs in
+const regionLabel = "region"
+
+// geoLocator finds the country and continent an IP is in, as ISO country
+// codes and two letter continent codes
+type geoLocator interface {
+	io.Closer
+	locate(ip net.IP) (country, continent string, err error)
+}
+
+type regionKey struct{}
+
+// geoRouter maps a client's IP to the region its requests prefer
+type geoRouter struct {
+	db         geoLocator
+	countries  map[string]string
+	continents map[string]string
+}
+
+func newGeoRouter(cfg *GeoIPConfig) (*geoRouter, error) {
+	db, err := openGeoDB(cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+	return &geoRouter{db: db, countries: cfg.Countries, continents: cfg.Continents}, nil
+}
+
+// withRegion notes the region of the client on the request, requests whose
+// client can't be located or is in no mapped place are left alone
+func (g *geoRouter) withRegion(r *http.Request) *http.Request {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return r
+	}
+	country, continent, err := g.db.locate(ip)
+	if err != nil {
+		return r
+	}
+	region, ok := g.countries[country]
+	if !ok {
+		region, ok = g.continents[continent]
+	}
+	if !ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), regionKey{}, region))
+}
+
+func regionFrom(ctx context.Context) string {
+	region, _ := ctx.Value(regionKey{}).(string)
+	return region
+}
+
+// geoAware prefers available backends in the client's region and leaves
+// the pick to the inner strategy over every backend when there are none
+type geoAware struct {
+	inner Strategy
+}
+
+func (s *geoAware) Next(backends []*Backend, r *http.Request) *Backend {
+	if region := regionFrom(r.Context()); region != "" {
+		var local []*Backend
+		for _, b := range backends {
+			if b.Labels[regionLabel] == region && b.Available() {
+				local = append(local, b)
+			}
+		}
+		if len(local) > 0 {
+			if b := s.inner.Next(local, r); b != nil {
+				return b
+			}
+		}
+	}
+	return s.inner.Next(backends, r)
+}
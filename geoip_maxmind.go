@@ -0,0 +1,34 @@
+//go:build geoip
+
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// maxMindDB locates IPs with a MaxMind country or city database
+type maxMindDB struct {
+	db *geoip2.Reader
+}
+
+func openGeoDB(path string) (geoLocator, error) {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return maxMindDB{db: db}, nil
+}
+
+func (m maxMindDB) locate(ip net.IP) (string, string, error) {
+	rec, err := m.db.Country(ip)
+	if err != nil {
+		return "", "", err
+	}
+	return rec.Country.IsoCode, rec.Continent.Code, nil
+}
+
+func (m maxMindDB) Close() error {
+	return m.db.Close()
+}
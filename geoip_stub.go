@@ -0,0 +1,11 @@
+//go:build !geoip
+
+package main
+
+import "errors"
+
+// openGeoDB fails without the geoip build tag, which pulls in the MaxMind
+// reader
+func openGeoDB(string) (geoLocator, error) {
+	return nil, errors.New("the MaxMind reader needs a build with -tags geoip")
+}
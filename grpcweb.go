@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	grpcContentType        = "application/grpc"
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+)
+
+// grpcWebTrailerFlag marks the frame carrying the trailers in a gRPC-Web body
+const grpcWebTrailerFlag = 0x80
+
+type grpcWebKey struct{}
+
+// grpcWebCall is a gRPC-Web request translated to gRPC, it remembers how
+// the client encoded the body so the response goes back the same way
+type grpcWebCall struct {
+	text bool
+}
+
+func grpcWebFrom(ctx context.Context) *grpcWebCall {
+	c, _ := ctx.Value(grpcWebKey{}).(*grpcWebCall)
+	return c
+}
+
+func isGRPCWeb(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), grpcWebContentType)
+}
+
+// grpcWebToGRPC turns a gRPC-Web request into a gRPC one, the message
+// framing is the same so only the content type changes and base64 bodies
+// are decoded
+func grpcWebToGRPC(r *http.Request) *http.Request {
+	ct := r.Header.Get("Content-Type")
+	call := &grpcWebCall{}
+	suffix, text := strings.CutPrefix(ct, grpcWebTextContentType)
+	if text {
+		call.text = true
+	} else {
+		suffix = strings.TrimPrefix(ct, grpcWebContentType)
+	}
+
+	r2 := r.WithContext(context.WithValue(r.Context(), grpcWebKey{}, call))
+	r2.Header = r.Header.Clone()
+	r2.Header.Set("Content-Type", grpcContentType+suffix)
+	r2.Header.Del("X-Grpc-Web")
+	if text {
+		r2.Body = readCloser{&base64Chunks{src: r.Body, buf: make([]byte, 32<<10)}, r.Body}
+		r2.ContentLength = -1
+		r2.Header.Del("Content-Length")
+	}
+	return r2
+}
+
+// isGRPC reports whether the request is a gRPC call, gRPC-Web ones
+// included once translated
+func isGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	suffix, ok := strings.CutPrefix(ct, grpcContentType)
+	return ok && (suffix == "" || suffix[0] == '+' || suffix[0] == ';')
+}
+
+// grpcTransport sends gRPC calls over HTTP/2, which gRPC needs, everything
+// else goes over the backend's regular transport. Each call is a stream of
+// its own and is balanced on its own, the stream then stays on the backend
+// it was sent to until it ends.
+type grpcTransport struct {
+	next http.RoundTripper
+	h2   *http.Transport
+}
+
+func (t grpcTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !isGRPC(r) {
+		return t.next.RoundTrip(r)
+	}
+	// the reverse proxy strips TE, gRPC servers insist on it
+	r = r.Clone(r.Context())
+	r.Header.Set("Te", "trailers")
+	return t.h2.RoundTrip(r)
+}
+
+// newH2Transport derives an HTTP/2 only transport from t, cleartext
+// backends are spoken to with prior knowledge
+func newH2Transport(t *http.Transport) *http.Transport {
+	h2 := t.Clone()
+	h2.Protocols = new(http.Protocols)
+	h2.Protocols.SetHTTP2(true)
+	h2.Protocols.SetUnencryptedHTTP2(true)
+	return h2
+}
+
+// grpcWebResponse turns the gRPC response to a translated request into a
+// gRPC-Web one, the HTTP trailers are sent as the last frame of the body
+func grpcWebResponse(resp *http.Response) {
+	call := grpcWebFrom(resp.Request.Context())
+	if call == nil {
+		return
+	}
+	suffix, ok := strings.CutPrefix(resp.Header.Get("Content-Type"), grpcContentType)
+	if !ok {
+		// not a gRPC answer, such as an error page, pass it on as it is
+		return
+	}
+	ct := grpcWebContentType
+	if call.text {
+		ct = grpcWebTextContentType
+	}
+	resp.Header.Set("Content-Type", ct+suffix)
+	resp.Header.Del("Trailer")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	// the trailers go in the body, the reverse proxy mustn't announce or
+	// send them, the transport sets them on the response at the end of the body
+	resp.Trailer = nil
+	body := io.ReadCloser(&grpcWebBody{src: resp.Body, resp: resp})
+	if call.text {
+		body = newBase64Body(body)
+	}
+	resp.Body = body
+}
+
+// grpcWebBody is a gRPC body followed by a trailer frame
+type grpcWebBody struct {
+	src  io.ReadCloser
+	resp *http.Response
+	tail *bytes.Reader
+}
+
+func (b *grpcWebBody) Read(p []byte) (int, error) {
+	if b.tail != nil {
+		return b.tail.Read(p)
+	}
+	n, err := b.src.Read(p)
+	if err == io.EOF {
+		b.tail = bytes.NewReader(grpcWebTrailerFrame(b.resp.Trailer))
+		b.resp.Trailer = nil
+		if n > 0 {
+			return n, nil
+		}
+		return b.tail.Read(p)
+	}
+	return n, err
+}
+
+func (b *grpcWebBody) Close() error {
+	return b.src.Close()
+}
+
+// grpcWebTrailerFrame encodes the trailers as "name: value" lines in a
+// frame flagged as trailers, no trailers make no frame
+func grpcWebTrailerFrame(trailer http.Header) []byte {
+	if len(trailer) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(trailer))
+	for k := range trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var payload bytes.Buffer
+	for _, k := range keys {
+		for _, v := range trailer[k] {
+			payload.WriteString(strings.ToLower(k) + ": " + v + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+payload.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(payload.Len()))
+	return append(frame, payload.Bytes()...)
+}
+
+// base64Body encodes a body as base64 while streaming it, whole 3 byte
+// groups are encoded as they come and the rest is padded at the end
+type base64Body struct {
+	src  io.ReadCloser
+	buf  []byte
+	rest []byte
+	out  []byte
+	eof  bool
+}
+
+func newBase64Body(src io.ReadCloser) *base64Body {
+	return &base64Body{src: src, buf: make([]byte, 32<<10)}
+}
+
+func (b *base64Body) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+		n, err := b.src.Read(b.buf)
+		b.rest = append(b.rest, b.buf[:n]...)
+		if err == io.EOF {
+			b.eof = true
+			b.out = []byte(base64.StdEncoding.EncodeToString(b.rest))
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		whole := len(b.rest) / 3 * 3
+		b.out = []byte(base64.StdEncoding.EncodeToString(b.rest[:whole]))
+		b.rest = append(b.rest[:0], b.rest[whole:]...)
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+func (b *base64Body) Close() error {
+	return b.src.Close()
+}
+
+// base64Chunks decodes a grpc-web-text request body. Clients may encode
+// each message on its own, padding included, so the body can be several
+// base64 strings one after the other. Every padded quartet ends one.
+type base64Chunks struct {
+	src  io.Reader
+	buf  []byte
+	rest []byte
+	out  []byte
+	err  error
+}
+
+func (d *base64Chunks) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			if d.err == io.EOF && len(d.rest) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, d.err
+		}
+		n, err := d.src.Read(d.buf)
+		for _, c := range d.buf[:n] {
+			// line breaks are allowed in base64 and carry nothing
+			if c != '\r' && c != '\n' {
+				d.rest = append(d.rest, c)
+			}
+		}
+		d.err = err
+		whole := len(d.rest) / 4 * 4
+		out := d.out[:0]
+		for start := 0; start < whole; {
+			end := whole
+			if i := bytes.IndexByte(d.rest[start:whole], '='); i >= 0 {
+				end = start + (i/4+1)*4
+			}
+			out = slices.Grow(out, base64.StdEncoding.DecodedLen(end-start))
+			m, err := base64.StdEncoding.Decode(out[len(out):cap(out)], d.rest[start:end])
+			if err != nil {
+				d.err = err
+				break
+			}
+			out = out[:len(out)+m]
+			start = end
+		}
+		d.out = out
+		d.rest = append(d.rest[:0], d.rest[whole:]...)
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
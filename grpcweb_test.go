@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// grpcStreamBackend answers with a stream of n gRPC messages sent every
+// interval, gRPC calls must come over cleartext HTTP/2
+func grpcStreamBackend(t *testing.T, n int, interval time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPC(r) && r.ProtoMajor != 2 {
+			http.Error(w, "gRPC needs HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", grpcContentType)
+		w.Header().Set("Trailer", "Grpc-Status")
+		for i := range n {
+			msg := fmt.Sprintf("message %d", i)
+			w.Write(append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...))
+			w.(http.Flusher).Flush()
+			time.Sleep(interval)
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGRPCStreamOutlivesRequestLimits(t *testing.T) {
+	backend := grpcStreamBackend(t, 5, 30*time.Millisecond)
+	lb := newTestLoadBalancer(t, []string{backend.URL}, func(cfg *Config) {
+		cfg.RequestTimeout = Duration{50 * time.Millisecond}
+		cfg.TotalRequestTimeout = Duration{50 * time.Millisecond}
+		cfg.MaxResponseBytes = 20
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/pkg.Service/Watch", bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	r.Header.Set("Content-Type", grpcContentType)
+	rec := do(lb, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	for i := range 5 {
+		if !bytes.Contains(rec.Body.Bytes(), fmt.Appendf(nil, "message %d", i)) {
+			t.Errorf("message %d missing from %q", i, rec.Body)
+		}
+	}
+	if s := rec.Result().Trailer.Get("Grpc-Status"); s != "0" {
+		t.Errorf("grpc-status %q, want 0", s)
+	}
+}
+
+func TestRequestLimitsStillApplyToOtherRequests(t *testing.T) {
+	backend := grpcStreamBackend(t, 5, 30*time.Millisecond)
+	lb := newTestLoadBalancer(t, []string{backend.URL}, func(cfg *Config) {
+		cfg.RequestTimeout = Duration{50 * time.Millisecond}
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/pkg.Service/Watch", nil)
+	if rec := do(lb, r); rec.Code == http.StatusOK && bytes.Contains(rec.Body.Bytes(), []byte("message 4")) {
+		t.Errorf("a plain request got the whole stream past its timeout")
+	}
+}
+
+func TestGRPCWebTextDecodesPaddedChunks(t *testing.T) {
+	frame := func(msg string) []byte {
+		return append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...)
+	}
+	first, second := frame("hi"), frame("there")
+	// each message encoded and padded on its own, as browser clients do
+	body := base64.StdEncoding.EncodeToString(first) + "\r\n" + base64.StdEncoding.EncodeToString(second)
+	if !strings.Contains(body, "=") {
+		t.Fatal("test body isn't padded")
+	}
+
+	for name, src := range map[string]func() io.Reader{
+		"whole":       func() io.Reader { return strings.NewReader(body) },
+		"byte a time": func() io.Reader { return iotest.OneByteReader(strings.NewReader(body)) },
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/pkg.Service/Call", src())
+		r.Header.Set("Content-Type", grpcWebTextContentType+"+proto")
+		got, err := io.ReadAll(grpcWebToGRPC(r).Body)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if want := append(first, second...); !bytes.Equal(got, want) {
+			t.Errorf("%s: decoded %q, want %q", name, got, want)
+		}
+	}
+}
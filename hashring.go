@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ringReplicas is the number of virtual nodes each backend gets on the ring
+const ringReplicas = 100
+
+// hashRing is a consistent hash ring of backends, adding or removing
+// a backend only remaps the keys that backend owns
+type hashRing struct {
+	backends []*Backend
+	// weights are the backends' weights the ring was built with, nil for
+	// a ring that gives every backend the same number of points
+	weights []int
+	points  []ringPoint
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+func newHashRing(backends []*Backend, weights []int) *hashRing {
+	r := &hashRing{backends: slices.Clone(backends), weights: weights}
+	for j, b := range backends {
+		replicas := ringReplicas
+		if weights != nil {
+			// a backend keeps the points it had as its weight changes, so
+			// only the keys on the points it gains or loses move
+			replicas = ringReplicas * max(weights[j], 0)
+		}
+		for i := range replicas {
+			r.points = append(r.points, ringPoint{hashKey(b.URL.String() + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	return r
+}
+
+// hashKey is FNV-1a with a finalizer mix so nearby keys spread over the ring
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// search returns the index of the first point at or after the key's hash
+func (r *hashRing) search(key string) int {
+	h := hashKey(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int {
+		switch {
+		case p.hash < h:
+			return -1
+		case p.hash > h:
+			return 1
+		}
+		return 0
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// owner returns the backend the key maps to regardless of its state
+func (r *hashRing) owner(key string) *Backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+	return r.points[r.search(key)].backend
+}
+
+// lookup returns the first available backend clockwise from the key
+func (r *hashRing) lookup(key string) *Backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+	start := r.search(key)
+	for i := range len(r.points) {
+		b := r.points[(start+i)%len(r.points)].backend
+		if b.Available() {
+			return b
+		}
+	}
+	return nil
+}
+
+// ringCache rebuilds the ring only when the backends it is asked about
+// change, or their weights for a weighted ring
+type ringCache struct {
+	weighted bool
+	mu       sync.Mutex
+	ring     *hashRing
+}
+
+func (c *ringCache) get(backends []*Backend) *hashRing {
+	var weights []int
+	if c.weighted {
+		weights = make([]int, len(backends))
+		for i, b := range backends {
+			weights[i] = b.Weight()
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring == nil || !slices.Equal(c.ring.backends, backends) || !slices.Equal(c.ring.weights, weights) {
+		c.ring = newHashRing(backends, weights)
+	}
+	return c.ring
+}
+
+// keyFunc extracts the key a request is hashed on
+type keyFunc func(r *http.Request) string
+
+// consistentHash maps the key of each request to a backend on a consistent
+// hash ring, ip-hash is this keyed on the client IP. On a weighted ring a
+// backend's share of the points, and so of the keys, follows its weight.
+type consistentHash struct {
+	key   keyFunc
+	rings ringCache
+}
+
+func (s *consistentHash) Next(backends []*Backend, r *http.Request) *Backend {
+	return s.rings.get(backends).lookup(s.key(r))
+}
+
+// newKeyFunc parses a hash key spec: "path", "query:<param>", "header:<name>"
+// or "cookie:<name>", requests missing the param, header or cookie all hash
+// on the empty key
+func newKeyFunc(spec string) (keyFunc, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "path":
+		if name == "" {
+			return func(r *http.Request) string { return r.URL.Path }, nil
+		}
+	case "query":
+		if name != "" {
+			return func(r *http.Request) string { return r.URL.Query().Get(name) }, nil
+		}
+	case "header":
+		if name != "" {
+			return func(r *http.Request) string { return r.Header.Get(name) }, nil
+		}
+	case "cookie":
+		if name != "" {
+			return func(r *http.Request) string {
+				c, err := r.Cookie(name)
+				if err != nil {
+					return ""
+				}
+				return c.Value
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid hash key %q", spec)
+}
+
+// clientIP returns the IP of the connection the request came in on
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// headerAffinity sends requests carrying the same header value to the same
+// backend, requests without the header or whose backend can't take them
+// are left to the inner strategy
+type headerAffinity struct {
+	header string
+	inner  Strategy
+	rings  ringCache
+}
+
+func (s *headerAffinity) Next(backends []*Backend, r *http.Request) *Backend {
+	if key := r.Header.Get(s.header); key != "" {
+		if b := s.rings.get(backends).owner(key); b != nil && b.Available() {
+			return b
+		}
+	}
+	return s.inner.Next(backends, r)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWeightedConsistentHashFollowsWeights(t *testing.T) {
+	urls := []string{"http://a.example", "http://b.example", "http://c.example"}
+	weights := []int{1, 2, 5}
+	lb := newTestLoadBalancer(t, urls, func(cfg *Config) {
+		cfg.Strategy = "weighted-consistent-hash"
+		for i := range cfg.Backends {
+			cfg.Backends[i].Weight = &weights[i]
+		}
+	})
+	backends := lb.Backends()
+	const keys = 20000
+	pick := func(backends []*Backend, key int) *Backend {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/item/%d", key), nil)
+		return lb.strategy.Next(backends, r)
+	}
+
+	counts := make(map[*Backend]int)
+	before := make([]*Backend, keys)
+	for k := range keys {
+		before[k] = pick(backends, k)
+		counts[before[k]]++
+	}
+	for i, b := range backends {
+		want := float64(weights[i]) / 8
+		if got := float64(counts[b]) / keys; math.Abs(got-want) > 0.03 {
+			t.Errorf("%s with weight %d got %.1f%% of the keys, want about %.1f%%", b.URL, weights[i], got*100, want*100)
+		}
+	}
+
+	// dropping a backend only moves the keys it owned
+	moved := 0
+	for k := range keys {
+		if before[k] == backends[1] {
+			continue
+		}
+		if pick([]*Backend{backends[0], backends[2]}, k) != before[k] {
+			moved++
+		}
+	}
+	if moved > 0 {
+		t.Errorf("%d keys of the remaining backends moved", moved)
+	}
+}
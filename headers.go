@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// stripHeaders removes the configured headers from a request before it is
+// forwarded, a trailing * in a name matches any suffix
+func stripHeaders(h http.Header, names []string) {
+	for _, name := range names {
+		prefix, wildcard := strings.CutSuffix(name, "*")
+		if !wildcard {
+			h.Del(name)
+			continue
+		}
+		prefix = http.CanonicalHeaderKey(prefix)
+		for k := range h {
+			if strings.HasPrefix(k, prefix) {
+				delete(h, k)
+			}
+		}
+	}
+}
+
+// http10Request drops what an HTTP/1.0 client can't mean on its way to a
+// backend, which is always spoken to in HTTP/1.1. A server must ignore
+// Upgrade and Expect: 100-continue in HTTP/1.0 requests, forwarding them
+// would switch protocols or hold the body back on the client's behalf.
+// Connection and Keep-Alive are hop-by-hop and dropped by the proxy, the
+// client's keep-alive is negotiated with the server, not the backend.
+func http10Request(r *http.Request) {
+	if r.ProtoAtLeast(1, 1) {
+		return
+	}
+	r.Header.Del("Upgrade")
+	r.Header.Del("Expect")
+}
+
+type preservedHeadersKey struct{}
+
+// preserveHeaders stashes the given headers in the request context, the
+// reverse proxy drops hop-by-hop headers after the director ran and
+// restoreHeaders puts them back
+func preserveHeaders(r *http.Request, names []string) {
+	saved := make(http.Header)
+	for _, name := range names {
+		if v := r.Header.Values(name); len(v) > 0 {
+			saved[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	if len(saved) > 0 {
+		*r = *r.WithContext(context.WithValue(r.Context(), preservedHeadersKey{}, saved))
+	}
+}
+
+// restoreHeaders wraps a transport to add back the headers preserveHeaders kept
+type restoreHeaders struct {
+	next http.RoundTripper
+}
+
+func (t restoreHeaders) RoundTrip(r *http.Request) (*http.Response, error) {
+	saved, _ := r.Context().Value(preservedHeadersKey{}).(http.Header)
+	if len(saved) == 0 {
+		return t.next.RoundTrip(r)
+	}
+	// a RoundTripper must not modify the request it is given
+	r = r.Clone(r.Context())
+	for k, v := range saved {
+		r.Header[k] = v
+	}
+	return t.next.RoundTrip(r)
+}
+
+// setResponseHeaders sets the configured response headers, {instance},
+// {backend}, {pool} and {route} in their values are filled in, b is nil
+// when no backend answered. A header whose value comes out empty is
+// removed, which also hides headers the backend sent. Responses on routes
+// whose preflights the load balancer answers also get the CORS headers.
+func (lb *LoadBalancer) setResponseHeaders(h http.Header, r *http.Request, b *Backend) {
+	if m := routeFrom(r.Context()); m != nil && m.route != nil && m.route.HandleOptions && r.Method != http.MethodOptions {
+		lb.allowOrigin(h, r)
+	}
+	if len(lb.cfg.ResponseHeaders) == 0 {
+		return
+	}
+	var backend, pool, route string
+	if b != nil {
+		backend, pool = b.URL.String(), b.Pool
+	}
+	if m := routeFrom(r.Context()); m != nil {
+		route = m.name
+		if b == nil {
+			pool = m.pool
+		}
+	}
+	vars := strings.NewReplacer("{instance}", lb.cfg.InstanceName, "{backend}", backend, "{pool}", pool, "{route}", route)
+	for name, tmpl := range lb.cfg.ResponseHeaders {
+		if v := vars.Replace(tmpl); v != "" {
+			h.Set(name, v)
+		} else {
+			h.Del(name)
+		}
+	}
+}
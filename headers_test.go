@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTP10Framing(t *testing.T) {
+	var seen atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen.Store(r.Header.Get("Upgrade") + "|" + r.Header.Get("Expect"))
+		if r.URL.Path == "/stream" {
+			// no length, an HTTP/1.1 client would get it chunked
+			w.Write([]byte("hello "))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("world"))
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	lb := newTestLoadBalancer(t, []string{backend.URL}, nil)
+	front := httptest.NewServer(lb)
+	defer front.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	t.Run("streamed body ends with the connection", func(t *testing.T) {
+		conn, br := dial()
+		defer conn.Close()
+		fmt.Fprint(conn, "GET /stream HTTP/1.0\r\nHost: lb\r\n\r\n")
+		raw, err := io.ReadAll(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, body, _ := strings.Cut(string(raw), "\r\n\r\n")
+		if strings.Contains(strings.ToLower(head), "transfer-encoding") {
+			t.Errorf("chunked response to an HTTP/1.0 client:\n%s", head)
+		}
+		if body != "hello world" {
+			t.Errorf("body %q, want hello world", body)
+		}
+	})
+
+	t.Run("upgrade and expect are dropped", func(t *testing.T) {
+		conn, br := dial()
+		defer conn.Close()
+		fmt.Fprint(conn, "POST / HTTP/1.0\r\nHost: lb\r\nUpgrade: websocket\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nhi")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, want 200 without a 100 Continue", resp.StatusCode)
+		}
+		if v := seen.Load(); v != "|" {
+			t.Errorf("backend got Upgrade|Expect %q", v)
+		}
+	})
+
+	t.Run("keep-alive", func(t *testing.T) {
+		conn, br := dial()
+		defer conn.Close()
+		for range 2 {
+			fmt.Fprint(conn, "GET / HTTP/1.0\r\nHost: lb\r\nConnection: keep-alive\r\n\r\n")
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "hello" || resp.Close {
+				t.Fatalf("body %q, closing %v, want hello on a kept connection", body, resp.Close)
+			}
+		}
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HealthResult is the outcome of probing a single backend
+type HealthResult struct {
+	URL   string `json:"url"`
+	Alive bool   `json:"alive"`
+	Error string `json:"error,omitempty"`
+}
+
+// probeResult is a health probe outcome not yet applied to the backend
+type probeResult struct {
+	latency time.Duration
+	// version is the version the backend reported, empty if none
+	version string
+	err     error
+}
+
+// probe runs a health probe against the backend, a probe already running
+// on the backend is waited for rather than overlapped
+func (b *Backend) probe(ctx context.Context) probeResult {
+	b.probeMu.Lock()
+	defer b.probeMu.Unlock()
+	start := time.Now()
+	version, err := b.health.check(withProbeTimeouts(ctx, b.probeTimeouts), cmp.Or(b.HealthCheckURL, b.URL))
+	return probeResult{latency: time.Since(start), version: version, err: err}
+}
+
+// HealthCheck pings the backends and updates their status
+func (lb *LoadBalancer) HealthCheck(ctx context.Context) []HealthResult {
+	return lb.checkBackends(ctx, lb.Backends())
+}
+
+// checkBackends probes the given backends and updates their status, the
+// other backends keep theirs
+func (lb *LoadBalancer) checkBackends(ctx context.Context, backends []*Backend) []HealthResult {
+	probes := make([]probeResult, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probes[i] = b.probe(ctx)
+		}()
+	}
+	wg.Wait()
+
+	results := make([]HealthResult, len(backends))
+	if ctx.Err() != nil {
+		// the check was called off, that says nothing about the backends
+		for i, b := range backends {
+			results[i] = HealthResult{URL: b.URL.String(), Alive: b.IsAlive(), Error: ctx.Err().Error()}
+		}
+		return results
+	}
+
+	failOpen := lb.cfg.HealthCheckFailOpen && allFailed(probes) && lb.othersFailed(backends)
+	if failOpen {
+		fmt.Printf("CRITICAL: all %d backends failed the health check, assuming the checker is broken and keeping them in rotation\n", len(lb.Backends()))
+	}
+	for i, b := range backends {
+		p := probes[i]
+		res := HealthResult{URL: b.URL.String(), Alive: p.err == nil || failOpen}
+		if p.err != nil {
+			fmt.Printf("server is unreachable: %s\n", p.err)
+			res.Error = p.err.Error()
+		}
+		wasAlive := b.IsAlive()
+		b.recordProbe(res.Alive, p.latency, p.err)
+		if res.Alive != wasAlive {
+			if res.Alive {
+				lb.emit(EventBackendUp, b.URL.String(), b.Pool, "passed its health check")
+			} else {
+				lb.emit(EventBackendDown, b.URL.String(), b.Pool, "failed its health check: %s", p.err)
+			}
+		}
+		if p.version != "" {
+			b.setVersion(p.version)
+		}
+		switch {
+		case p.err != nil && failOpen:
+			fmt.Printf("server %s kept in rotation (fail-open)\n", b.URL)
+		case res.Alive:
+			fmt.Printf("server %s is alive\n", b.URL)
+		default:
+			fmt.Printf("server %s is dead\n", b.URL)
+		}
+		results[i] = res
+	}
+	if lb.cfg.ProbeWeight != nil {
+		lb.probeWeight(backends, probes)
+	}
+	lb.rebuildSelectable()
+	lb.checkDegraded()
+	return results
+}
+
+func allFailed(probes []probeResult) bool {
+	for _, p := range probes {
+		if p.err == nil {
+			return false
+		}
+	}
+	return len(probes) > 0
+}
+
+// othersFailed reports whether the last probe failed on every backend
+// not in the given ones
+func (lb *LoadBalancer) othersFailed(backends []*Backend) bool {
+	for _, b := range lb.Backends() {
+		if slices.Contains(backends, b) {
+			continue
+		}
+		b.mu.RLock()
+		failed := b.probeFailed
+		b.mu.RUnlock()
+		if !failed {
+			return false
+		}
+	}
+	return true
+}
+
+// HealthCheckPeriodically probes each backend every HealthCheckInterval
+// until ctx is done, backends due at the same time are probed together.
+// Backends added meanwhile join the schedule the next time it wakes up.
+func (lb *LoadBalancer) HealthCheckPeriodically(ctx context.Context) {
+	var schedule probeSchedule
+	scheduled := make(map[*Backend]bool)
+	started := time.Now()
+	now := started
+	for _, b := range lb.Backends() {
+		schedule = append(schedule, scheduledProbe{backend: b, next: now.Add(lb.probeInterval(b, started))})
+		scheduled[b] = true
+	}
+	heap.Init(&schedule)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		wait := lb.cfg.HealthCheckInterval.Duration
+		if len(schedule) > 0 {
+			wait = time.Until(schedule[0].next)
+		}
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		now := time.Now()
+		backends := lb.Backends()
+		for _, b := range backends {
+			if !scheduled[b] {
+				// added since the last wake up, its first check already ran
+				heap.Push(&schedule, scheduledProbe{backend: b, next: now.Add(lb.probeInterval(b, started))})
+				scheduled[b] = true
+			}
+		}
+		var due []*Backend
+		for len(schedule) > 0 && !schedule[0].next.After(now) {
+			p := heap.Pop(&schedule).(scheduledProbe)
+			// removed backends drop out of the schedule
+			if slices.Contains(backends, p.backend) {
+				due = append(due, p.backend)
+			} else {
+				delete(scheduled, p.backend)
+			}
+		}
+		lb.checkBackends(ctx, due)
+		for _, b := range due {
+			heap.Push(&schedule, scheduledProbe{backend: b, next: now.Add(lb.probeInterval(b, started))})
+		}
+	}
+}
+
+// probeInterval is how long until the backend's next probe. During the
+// startup grace period backends that haven't come up yet are probed at
+// the faster startup interval, so backends still booting alongside the
+// load balancer join as soon as they are ready, once up they relax to
+// their normal interval.
+func (lb *LoadBalancer) probeInterval(b *Backend, started time.Time) time.Duration {
+	if time.Since(started) < lb.cfg.StartupGracePeriod.Duration && !b.IsAlive() {
+		return min(lb.cfg.StartupProbeInterval.Duration, b.HealthCheckInterval)
+	}
+	return b.HealthCheckInterval
+}
+
+// scheduledProbe is a backend and when it is next due for a probe
+type scheduledProbe struct {
+	backend *Backend
+	next    time.Time
+}
+
+// probeSchedule is a min-heap of probes, the next one due first
+type probeSchedule []scheduledProbe
+
+func (s probeSchedule) Len() int           { return len(s) }
+func (s probeSchedule) Less(i, j int) bool { return s[i].next.Before(s[j].next) }
+func (s probeSchedule) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (s *probeSchedule) Push(x any) {
+	*s = append(*s, x.(scheduledProbe))
+}
+
+func (s *probeSchedule) Pop() any {
+	old := *s
+	p := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,31 @@
+package main
+
+import "sync/atomic"
+
+// inFlightLimit caps the requests the load balancer serves at once, the
+// ones over the limit are shed so the process itself isn't overwhelmed
+type inFlightLimit struct {
+	// max is the limit, 0 is no limit
+	max  int64
+	n    atomic.Int64
+	shed atomic.Uint64
+}
+
+// acquire reserves a slot for a request, it fails and counts the request
+// as shed if the limit is reached
+func (l *inFlightLimit) acquire() bool {
+	for {
+		n := l.n.Load()
+		if l.max > 0 && n >= l.max {
+			l.shed.Add(1)
+			return false
+		}
+		if l.n.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (l *inFlightLimit) release() {
+	l.n.Add(-1)
+}
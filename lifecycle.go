@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+)
+
+// Start runs the initial health check and starts the background loops,
+// they run until Close
+func (lb *LoadBalancer) Start() {
+	if lb.webhook != nil {
+		lb.background(lb.webhook.Run)
+	}
+	lb.HealthCheck(lb.ctx)
+
+	lb.background(lb.HealthCheckPeriodically)
+	lb.background(func(ctx context.Context) {
+		lb.trafficSharePeriodically(ctx, lb.cfg.StatsWindow.Duration)
+	})
+	lb.background(lb.errorLog.summarizePeriodically)
+	if lb.cfg.AutoWeight != nil {
+		lb.background(lb.autoWeightPeriodically)
+	}
+	if lb.auditor != nil {
+		lb.background(lb.auditPeriodically)
+	}
+}
+
+// background runs f in a goroutine Close stops and waits for
+func (lb *LoadBalancer) background(f func(ctx context.Context)) {
+	lb.wg.Add(1)
+	go func() {
+		defer lb.wg.Done()
+		f(lb.ctx)
+	}()
+}
+
+// Close stops the background loops, waits for them to return and closes
+// the backends', the probes' and the webhook's idle connections, requests
+// in flight are not interrupted
+func (lb *LoadBalancer) Close() error {
+	lb.stop()
+	lb.wg.Wait()
+	lb.defaultHealth.closeIdleConnections()
+	for _, h := range lb.health {
+		h.closeIdleConnections()
+	}
+	if lb.webhook != nil {
+		lb.webhook.client.CloseIdleConnections()
+	}
+	for _, b := range lb.Backends() {
+		b.closeIdleConnections()
+	}
+	if lb.sorry != nil {
+		lb.sorry.closeIdleConnections()
+	}
+	if lb.dualWrite != nil {
+		lb.dualWrite.secondary.closeIdleConnections()
+	}
+	if lb.geo != nil {
+		return lb.geo.db.Close()
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestStartCloseLeavesNoGoroutines(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+
+	before := runtime.NumGoroutine()
+	for range 3 {
+		cfg := defaultConfig()
+		cfg.Backends = []BackendConfig{{URL: backend.URL}}
+		cfg.HealthCheckInterval = Duration{10 * time.Millisecond}
+		cfg.StatsWindow = Duration{10 * time.Millisecond}
+		cfg.ErrorLogInterval = Duration{10 * time.Millisecond}
+		cfg.AutoWeight = &AutoWeightConfig{MinWeight: 1, MaxWeight: 10, Interval: Duration{10 * time.Millisecond}}
+		cfg.HealthChecks = []ProbeConfig{{Type: "http", Path: "/"}}
+		cfg.Webhook = &WebhookConfig{URL: hook.URL}
+		if err := cfg.validate(); err != nil {
+			t.Fatal(err)
+		}
+		lb, err := NewLoadBalancer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb.Start()
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", rec.Code)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := lb.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// connections the servers hold on to wind down on their own
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("%d goroutines before Start, %d after Close:\n%s", before, n, buf[:runtime.Stack(buf, true)])
+	}
+}
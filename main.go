@@ -1,141 +1,681 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net"
+	"math/rand"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
-// Backend server
-type Backend struct {
-	URL          *url.URL
-	Alive        bool
-	ReverseProxy *httputil.ReverseProxy
-	mu           sync.RWMutex
+type LoadBalancer struct {
+	cfg *Config
+	// backends, pools and selectable are guarded by mu, they are replaced on change
+	// and never modified in place
+	backends []*Backend
+	// pools groups the backends by pool name
+	pools map[string][]*Backend
+	// selectable groups the backends strategies may pick from by pool name,
+	// dead, draining and weight 0 backends are left out so selection
+	// doesn't have to skip over them, see rebuildSelectable
+	selectable map[string][]*Backend
+	mu         sync.RWMutex
+	strategy   Strategy
+	// health holds the health checkers of the pools with their own
+	// settings, the other pools use defaultHealth
+	health        map[string]*healthChecker
+	defaultHealth *healthChecker
+	coalescer     *coalescer
+	requestLog    *requestLog
+	accessLog     *accessLog
+	errorLog      *errorLog
+	// ctx is canceled by Close to stop the background loops in wg
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+	// stickyCookie sets the session cookie on responses, nil if disabled
+	stickyCookie *cookieAffinity
+	// sorry serves the requests no backend can take, nil if not configured,
+	// it is not health checked and not in any pool
+	sorry *Backend
+	// state persists the changes made through the admin API, nil if disabled
+	state *poolState
+	// degraded tracks the pools below the degraded threshold
+	degraded degradedPools
+	// routeStats counts the requests of each route
+	routeStats *routeStats
+	// inFlight limits the requests served at once
+	inFlight inFlightLimit
+	// eventHandlers are called with every event, see OnEvent
+	eventHandlers []func(Event)
+	// webhook delivers the events to the configured webhook, nil if disabled
+	webhook *WebhookNotifier
+	// filters run before a request is routed, see Use
+	filters []RequestFilter
+	// requestCost estimates the requests' cost, nil if each counts as 1,
+	// see SetRequestCost
+	requestCost RequestCost
+	// auditor checks the request distribution against the weights, nil if disabled
+	auditor *distributionAuditor
+	// splits are the A/B splits of the routes that have one
+	splits map[*RouteConfig]*abSplit
+	// override routes requests carrying a signed token, nil if disabled
+	override *tokenOverride
+	// pruners keep state per backend, they are pruned as backends are removed
+	pruners []pruner
+	// pin sends trusted clients' requests to the backend they name, nil if disabled
+	pin *debugPin
+	// dualWrite sends writes to a secondary backend too, nil if disabled
+	dualWrite *dualWrite
+	// maintenance is the maintenance page, nil if disabled
+	maintenance *maintenancePage
+	// retryBudget caps the retries, nil if unlimited
+	retryBudget *retryBudget
+	// geo maps clients to the region they prefer, nil if disabled
+	geo *geoRouter
+	// stale serves stale responses while the backends fail, nil if disabled
+	stale *staleCache
+	// backendCAs verify the certificates of https backends, nil for the
+	// system roots
+	backendCAs *x509.CertPool
+	// stripRequestHeaders are the configured headers to strip plus the
+	// ones only meant for the load balancer
+	stripRequestHeaders []string
 }
 
-func (b *Backend) SetAlive(alive bool) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.Alive = alive
+// NewLoadBalancer creates a load balancer for the configured backends
+func NewLoadBalancer(cfg *Config) (*LoadBalancer, error) {
+	lb := &LoadBalancer{
+		cfg:                 cfg,
+		pools:               make(map[string][]*Backend),
+		errorLog:            newErrorLog(cfg.ErrorLogLimit, cfg.ErrorLogInterval.Duration),
+		stripRequestHeaders: slices.Clone(cfg.StripRequestHeaders),
+		routeStats:          newRouteStats(cfg.Routes),
+		splits:              make(map[*RouteConfig]*abSplit),
+		degraded:            degradedPools{pools: make(map[string]bool)},
+	}
+	lb.inFlight.max = cfg.MaxInFlight
+	if cfg.StaleIfError != nil {
+		stale, err := newStaleCache(cfg.StaleIfError)
+		if err != nil {
+			return nil, fmt.Errorf("stale_if_error: %w", err)
+		}
+		lb.stale = stale
+		// the bypass is for the load balancer, backends don't need to see it
+		lb.stripRequestHeaders = append(lb.stripRequestHeaders, stale.bypassHeader)
+	}
+	if cfg.RetryBudget != nil {
+		lb.retryBudget = newRetryBudget(cfg.RetryBudget)
+	}
+	if cfg.Maintenance != nil {
+		page, err := newMaintenancePage(cfg.Maintenance)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance page: %w", err)
+		}
+		lb.maintenance = page
+	}
+	if cfg.Webhook != nil {
+		lb.webhook = NewWebhookNotifier(cfg.Webhook)
+		lb.OnEvent(lb.webhook.Notify)
+	}
+	lb.ctx, lb.stop = context.WithCancel(context.Background())
+
+	store := cfg.StateStore
+	if store == nil && cfg.StateFile != "" {
+		store = fileStateStore{path: cfg.StateFile}
+	}
+	if store != nil {
+		state, err := loadPoolState(store)
+		if err != nil {
+			return nil, err
+		}
+		lb.state = state
+	}
+
+	if cfg.BackendCAFile != "" {
+		cas, err := loadCertPool(cfg.BackendCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("backend_ca_file: %w", err)
+		}
+		lb.backendCAs = cas
+	}
+
+	health, err := newHealthChecker(cfg, nil, lb.backendCAs)
+	if err != nil {
+		return nil, err
+	}
+	lb.defaultHealth = health
+	lb.health = make(map[string]*healthChecker)
+	for name, ph := range cfg.PoolHealth {
+		if lb.health[name], err = newHealthChecker(cfg, ph, lb.backendCAs); err != nil {
+			return nil, fmt.Errorf("pool_health %q: %w", name, err)
+		}
+	}
+
+	for _, bc := range cfg.Backends {
+		b, err := lb.newBackend(bc)
+		if err != nil {
+			return nil, err
+		}
+		if lb.state != nil {
+			if lb.state.removed(b.URL) {
+				continue
+			}
+			if w, ok := lb.state.weight(b.URL); ok {
+				b.SetWeight(w)
+			}
+		}
+		lb.backends = append(lb.backends, b)
+		lb.pools[b.Pool] = append(lb.pools[b.Pool], b)
+	}
+	if cfg.SorryBackend != nil {
+		if lb.sorry, err = lb.newBackend(*cfg.SorryBackend); err != nil {
+			return nil, fmt.Errorf("sorry backend: %w", err)
+		}
+		lb.sorry.SetAlive(true)
+	}
+	if cfg.RequestCost != nil {
+		if lb.requestCost, err = newRequestCost(cfg.RequestCost); err != nil {
+			return nil, fmt.Errorf("request_cost: %w", err)
+		}
+		if cfg.RequestCost.Header != "" {
+			// the cost is for the load balancer, backends don't need to see it
+			lb.stripRequestHeaders = append(lb.stripRequestHeaders, cfg.RequestCost.Header)
+		}
+	}
+	if cfg.DualWrite != nil {
+		if lb.dualWrite, err = lb.newDualWrite(cfg.DualWrite); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TLS != nil {
+		for name, pool := range cfg.TLS.SNIPools {
+			if len(lb.pools[pool]) == 0 {
+				return nil, fmt.Errorf("sni %s: pool %q has no backends", name, pool)
+			}
+		}
+	}
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		if len(lb.pools[route.Pool]) == 0 {
+			return nil, fmt.Errorf("route to pool %q: pool has no backends", route.Pool)
+		}
+		if route.Split == nil {
+			continue
+		}
+		split, err := newABSplit(route.Split)
+		if err != nil {
+			return nil, fmt.Errorf("route %s split: %w", routeName(route), err)
+		}
+		for _, v := range route.Split.Variants {
+			if len(lb.pools[v.Pool]) == 0 {
+				return nil, fmt.Errorf("route %s variant %s: pool %q has no backends", routeName(route), v.Name, v.Pool)
+			}
+		}
+		lb.splits[route] = split
+	}
+	for name := range cfg.PoolHealth {
+		if len(lb.pools[name]) == 0 {
+			return nil, fmt.Errorf("pool_health %q: pool has no backends", name)
+		}
+	}
+	for _, name := range cfg.UpstreamGzipPools {
+		if len(lb.pools[name]) == 0 {
+			return nil, fmt.Errorf("upstream_gzip_pools %q: pool has no backends", name)
+		}
+	}
+	if cfg.DefaultPool != "" && len(lb.pools[cfg.DefaultPool]) == 0 {
+		return nil, fmt.Errorf("default pool %q has no backends", cfg.DefaultPool)
+	}
+
+	lb.rebuildSelectable()
+
+	if cfg.Coalesce {
+		lb.coalescer = newCoalescer(cfg.CoalesceHeaders)
+	}
+	if cfg.DebugBufferSize > 0 {
+		lb.requestLog = newRequestLog(cfg.DebugBufferSize)
+	}
+	if cfg.AccessLog {
+		lb.accessLog = newAccessLog(os.Stdout, cfg.AccessLogFields)
+	}
+
+	var opts []StrategyOption
+	if cfg.SelectionSeed != 0 {
+		opts = append(opts, WithRandSource(rand.NewSource(cfg.SelectionSeed)))
+	}
+	var strategy Strategy
+	if len(cfg.StrategyChain) > 0 {
+		strategy, err = newChainStrategy(cfg.StrategyChain, opts...)
+	} else {
+		strategy, err = newStrategy(cfg.Strategy, cfg.HashKey, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lb.strategy = strategy
+	lb.pruners = append(lb.pruners, strategyPruners(strategy)...)
+	if cfg.DistributionAudit != nil {
+		wrr, ok := strategy.(*weightedRoundRobin)
+		if !ok {
+			return nil, fmt.Errorf("distribution_audit needs the weighted-round-robin strategy")
+		}
+		lb.auditor = newDistributionAuditor(cfg.DistributionAudit, wrr)
+	}
+	if cfg.LocalZone != "" {
+		lb.strategy = &localityAware{zone: cfg.LocalZone, inner: lb.strategy}
+	}
+	if cfg.GeoIP != nil {
+		if lb.geo, err = newGeoRouter(cfg.GeoIP); err != nil {
+			return nil, fmt.Errorf("geoip: %w", err)
+		}
+		lb.strategy = &geoAware{inner: lb.strategy}
+	}
+	if cfg.AffinityHeader != "" {
+		lb.strategy = &headerAffinity{header: cfg.AffinityHeader, inner: lb.strategy}
+	}
+	if cfg.StickyCookie != nil {
+		lb.stickyCookie = newCookieAffinity(cfg.StickyCookie, lb.strategy)
+		lb.strategy = lb.stickyCookie
+		lb.pruners = append(lb.pruners, lb.stickyCookie)
+	}
+	if cfg.Pin != nil {
+		pin, err := newDebugPin(cfg.Pin, lb.strategy, lb.backendByURL)
+		if err != nil {
+			return nil, err
+		}
+		lb.strategy = pin
+		lb.pin = pin
+		// the pin is for the load balancer, backends don't need to see it
+		lb.stripRequestHeaders = append(lb.stripRequestHeaders, pin.header)
+	}
+	if cfg.Override != nil {
+		lb.override = newTokenOverride(cfg.Override, lb.strategy)
+		lb.strategy = lb.override
+		lb.stripRequestHeaders = append(lb.stripRequestHeaders, lb.override.header)
+	}
+	return lb, nil
 }
 
-func (b *Backend) IsAlive() bool {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	return b.Alive
+// NextBackend returns the next available backend to handle the request
+func (lb *LoadBalancer) NextBackend(r *http.Request) *Backend {
+	return lb.strategy.Next(lb.candidates(lb.poolFor(r)), r)
 }
 
-type LoadBalancer struct {
-	backends []*Backend
-	current  int
-	mu       sync.Mutex
+// acquireBackend picks a backend and reserves a connection slot on it, it
+// returns nil rather than overloading a backend when all are saturated. A
+// backend with a max rate is waited on before the slot is reserved, so a
+// request queued for its turn doesn't hold one. The error is the rate
+// queue's, it comes with the backend whose queue turned the request away.
+func (lb *LoadBalancer) acquireBackend(pool []*Backend, r *http.Request) (*Backend, error) {
+	for range len(pool) {
+		b := lb.strategy.Next(pool, r)
+		if b == nil {
+			return nil, nil
+		}
+		if b.shaper != nil {
+			if err := b.shaper.wait(r.Context()); err != nil {
+				return b, err
+			}
+		}
+		if b.acquire() {
+			return b, nil
+		}
+	}
+	return nil, nil
 }
 
-// NextBackend returns the next available backend to handle the request
-func (lb *LoadBalancer) NextBackend() *Backend {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
-	nBackends := len(lb.backends)
-	next := (lb.current + 1) % nBackends
-	for i := 0; i < nBackends; i++ {
-		idx := (next + i) % nBackends
-		if lb.backends[idx].IsAlive() {
-			lb.current = idx
-			return lb.backends[idx]
-		}
-	}
-	return nil
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !lb.inFlight.acquire() {
+		status := http.StatusServiceUnavailable
+		http.Error(w, strings.ToLower(http.StatusText(status)), status)
+		return
+	}
+	defer lb.inFlight.release()
+	if lb.cfg.NormalizePath {
+		r = lb.normalizeRequest(r)
+	}
+	r, route := lb.matchRoute(r)
+	if lb.override != nil {
+		r = lb.override.apply(lb, r, route)
+	}
+	if lb.geo != nil {
+		r = lb.geo.withRegion(r)
+	}
+	r = lb.limitBodyRate(w, r)
+	r, s := withServedBy(r)
+	r, requestID := lb.withRequestID(w, r)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	if handlesOptions(r, route) {
+		lb.answerOptions(sw, r)
+	} else {
+		lb.serve(sw, r)
+	}
+	if sw.status == 0 && errors.Is(r.Context().Err(), context.Canceled) {
+		sw.status = statusClientClosedRequest
+	}
+	lb.routeStats.observe(route.name, sw.status, time.Since(start))
+	if lb.requestLog == nil && lb.accessLog == nil {
+		return
+	}
+	rec := newRequestRecord(r, s, sw, start)
+	rec.RequestID = requestID
+	if lb.requestLog != nil {
+		lb.requestLog.add(rec)
+	}
+	if lb.accessLog != nil {
+		lb.accessLog.log(rec)
+	}
 }
 
-func isBackendAlive(u *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", u.Host, timeout)
-	if err != nil {
-		fmt.Printf("server is unreachable: %s\n", err)
-		return false
+// RequestFilter validates a request before it is routed, a zero status lets
+// the request through, any other answers it with that status and the
+// error's message without it reaching a backend
+type RequestFilter func(*http.Request) (int, error)
+
+// Use adds filters to run on every request, in the order they were added,
+// it must be called before the load balancer serves requests
+func (lb *LoadBalancer) Use(filters ...RequestFilter) {
+	lb.filters = append(lb.filters, filters...)
+}
+
+// steered reports whether an override token or the debug pin sent the
+// request to a backend or pool of the caller's choosing, its response is
+// then the caller's own and isn't shared through coalescing or caching
+func (lb *LoadBalancer) steered(r *http.Request) bool {
+	return overridden(r.Context()) || lb.pin != nil && lb.pin.applies(r)
+}
+
+// serve forwards the request, coalescing it with identical ones when enabled
+func (lb *LoadBalancer) serve(w http.ResponseWriter, r *http.Request) {
+	if lb.maintenance != nil && lb.maintenance.serve(w, r) {
+		return
 	}
-	defer conn.Close()
-	return true
+	for _, filter := range lb.filters {
+		if status, err := filter(r); status != 0 {
+			msg := strings.ToLower(http.StatusText(status))
+			if err != nil {
+				msg = err.Error()
+			}
+			lb.setResponseHeaders(w.Header(), r, nil)
+			http.Error(w, msg, status)
+			return
+		}
+	}
+	if lb.coalescer != nil && coalescable(r) && !lb.steered(r) {
+		lb.coalescer.serve(w, r, lb.proxy)
+		return
+	}
+	lb.proxy(w, r)
 }
 
-// HealthCheck pings the backends and updates their status
-func (lb *LoadBalancer) HealthCheck() {
-	for _, b := range lb.backends {
-		status := isBackendAlive(b.URL)
-		b.SetAlive(status)
-		if status {
-			fmt.Printf("server %s is alive\n", b.URL)
-		} else {
-			fmt.Printf("server %s is dead\n", b.URL)
+// proxy forwards the request to the next available backend
+func (lb *LoadBalancer) proxy(w http.ResponseWriter, r *http.Request) {
+	m := routeFrom(r.Context())
+	name, route := m.pool, m.route
+	if len(lb.pool(name)) == 0 {
+		// no rule matched and there is no default pool to fall back on
+		lb.setResponseHeaders(w.Header(), r, nil)
+		http.NotFound(w, r)
+		return
+	}
+	if route != nil && route.GRPCWeb && isGRPCWeb(r) {
+		r = grpcWebToGRPC(r)
+	}
+	pool := lb.candidates(name)
+	if route != nil && len(route.BackendLabels) > 0 {
+		pool = slices.DeleteFunc(slices.Clone(pool), func(b *Backend) bool { return !b.hasLabels(route.BackendLabels) })
+	}
+	if lb.stale != nil && !lb.steered(r) {
+		r = lb.stale.withKey(r)
+		if e := lb.stale.fresh(r); e != nil {
+			if notModified(r, e.header) {
+				// the client's copy is the one in the cache, the backends needn't be asked
+				lb.setResponseHeaders(w.Header(), r, nil)
+				e.writeNotModified(w)
+				return
+			}
+			if r.Method == http.MethodHead && lb.stale.head == headFresh {
+				lb.setResponseHeaders(w.Header(), r, nil)
+				e.writeHead(w)
+				return
+			}
 		}
 	}
+	if lb.retryBudget != nil {
+		lb.retryBudget.request()
+	}
+	if lb.requestCost != nil {
+		r = lb.withRequestCost(r)
+	}
+	if timeout := lb.cfg.TotalRequestTimeout.Duration; timeout > 0 && !isGRPC(r) {
+		// one budget for every attempt, retries don't get a fresh timeout
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	var dualBody []byte
+	dual := false
+	if lb.dualWrite != nil {
+		dualBody, dual = lb.dualWrite.prepare(r, pool)
+	}
+	for retries := 0; ; retries++ {
+		if retries > 0 && lb.cfg.RetryBackoff != nil {
+			retryBackoff(r.Context(), lb.cfg.RetryBackoff, retries)
+		}
+		if retries > 0 && r.Context().Err() != nil {
+			if lb.stale != nil && lb.stale.serve(w, r) {
+				return
+			}
+			lb.setResponseHeaders(w.Header(), r, nil)
+			http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+			return
+		}
+		backend, err := lb.acquireBackend(pool, r)
+		if err != nil {
+			lb.errorLog.log(backend.URL.String(), err)
+			lb.setResponseHeaders(w.Header(), r, backend)
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if backend == nil && lb.stale != nil && lb.stale.serve(w, r) {
+			// a stale answer beats a sorry page
+			return
+		}
+		if backend == nil && lb.sorry != nil && lb.sorry.acquire() {
+			// no backend can take the request, let the sorry server apologize
+			lb.forward(lb.sorry, w, r, &attempt{})
+			return
+		}
+		if backend == nil {
+			lb.setResponseHeaders(w.Header(), r, nil)
+			if lb.maintenance != nil {
+				lb.maintenance.servePage(w, r, http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		a := &attempt{canRetry: retries < lb.cfg.MaxRetries && len(pool) > 1}
+		if dual && backend == lb.dualWrite.primary {
+			if lb.dualWrite.forward(lb, w, r, a, dualBody) {
+				return
+			}
+		} else if lb.forward(backend, w, r, a) {
+			return
+		}
+		lb.errorLog.log(backend.URL.String(), fmt.Errorf("retrying on another backend: %w", a.err))
+		pool = slices.DeleteFunc(slices.Clone(pool), func(b *Backend) bool { return b == backend })
+	}
 }
 
-// HealthCheckPeriodically runs a routine health check every interval
-func (lb *LoadBalancer) HealthCheckPeriodically(interval time.Duration) {
-	for range time.Tick(interval) {
-		lb.HealthCheck()
+// forward sends the request to the backend, which must have been acquired,
+// it returns false if the attempt failed and the request can go to another
+// backend
+func (lb *LoadBalancer) forward(b *Backend, w http.ResponseWriter, r *http.Request, a *attempt) bool {
+	// released even if the proxy panics, as it does to abort a response
+	defer b.release()
+	if s := servedByFrom(r.Context()); s != nil {
+		s.backend.Store(b)
+	}
+	if c, ok := requestCostFrom(r.Context()); ok {
+		b.addCost(c)
+		defer b.addCost(-c)
+	}
+	ctx := withAttempt(r.Context(), a)
+	if b.RequestTimeout > 0 && !isGRPC(r) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.RequestTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	inFlight := b.activeConns.Load()
+	b.ReverseProxy.ServeHTTP(w, r.WithContext(ctx))
+	if a.err != nil {
+		return false
+	}
+	if !errors.Is(r.Context().Err(), context.Canceled) {
+		b.observeLatency(time.Since(start))
+		if b.adaptive != nil {
+			b.adaptive.observe(time.Since(start), inFlight)
+		}
 	}
+	return true
 }
 
-func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	backend := lb.NextBackend()
-	if backend == nil {
-		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
-		return
+// newServer creates the client facing server with the configured limits
+func newServer(cfg *Config, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout.Duration,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.Duration,
+		WriteTimeout:      cfg.WriteTimeout.Duration,
+		IdleTimeout:       cfg.IdleTimeout.Duration,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if cfg.H2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
 	}
-	// forward request
-	backend.ReverseProxy.ServeHTTP(w, r)
+	return server
 }
 
 func main() {
-	port := 8000
-	serverList := []string{
-		"http://localhost:8001",
-		"http://localhost:8002",
-		"http://localhost:8003",
-		"http://localhost:8004",
-		"http://localhost:8005",
-	}
+	configPath := flag.String("config", "", "path to the JSON config file")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	validate := flag.Bool("validate", false, "check every backend is reachable, print a report and exit, non-zero if one isn't")
+	flag.Parse()
 
-	lb := new(LoadBalancer)
+	if *showVersion {
+		fmt.Println(buildVersion())
+		return
+	}
 
-	for _, serverURL := range serverList {
-		u, err := url.Parse(serverURL)
-		if err != nil {
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		if cfg, err = LoadConfig(*configPath); err != nil {
 			log.Fatal(err)
 		}
+	}
+	if err := LoadConfigFromEnv(cfg); err != nil {
+		log.Fatal(err)
+	}
 
-		proxy := httputil.NewSingleHostReverseProxy(u)
-		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-			fmt.Println(err)
-			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
-		}
+	lb, err := NewLoadBalancer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		lb.backends = append(lb.backends, &Backend{
-			URL:          u,
-			ReverseProxy: proxy,
-		})
+	if *validate {
+		// no listener and no background loops, just the report
+		if !writeReachability(os.Stdout, lb.CheckReachability(context.Background())) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	// initial health check
-	lb.HealthCheck()
+	lb.Start()
+	defer lb.Close()
 
-	// start periodic health check
-	go lb.HealthCheckPeriodically(10 * time.Second)
+	ctx := context.Background()
 
-	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: lb,
+	up, err := newUpgrader()
+	if err != nil {
+		log.Fatal(err)
 	}
-	fmt.Println("load balancer started on port:", port)
-	if err := server.ListenAndServe(); err != nil {
+
+	if cfg.AdminPort != 0 {
+		ln, err := up.listen("admin", fmt.Sprintf(":%d", cfg.AdminPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go lb.serveAdmin(ln)
+	}
+
+	server := newServer(cfg, lb)
+	if cfg.TLS != nil {
+		certs, err := newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go certs.watchSignals(ctx)
+		auth, cas, err := clientAuth(cfg.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, ClientAuth: auth, ClientCAs: cas}
+	}
+	ln, err := up.listen("main", server.Addr)
+	if err != nil {
 		log.Fatal(err)
 	}
+	go func() {
+		fmt.Println("load balancer started on port:", cfg.Port)
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	up.serving()
+
+	// SIGUSR2 hands the listeners to a new process, then like SIGINT and
+	// SIGTERM stops accepting and waits for the requests in flight
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+	for s := range sig {
+		if s == syscall.SIGUSR2 {
+			if err := up.upgrade(); err != nil {
+				fmt.Printf("upgrade failed: %s\n", err)
+				continue
+			}
+			fmt.Println("upgraded, draining")
+		}
+		break
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("shutdown: %s\n", err)
+	}
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestLoadBalancer creates a load balancer for the backend URLs, setup
+// adjusts the config before it is validated. The backends start alive and
+// the load balancer is closed when the test ends.
+func newTestLoadBalancer(t testing.TB, urls []string, setup func(*Config)) *LoadBalancer {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Backends = nil
+	for _, u := range urls {
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: u})
+	}
+	if setup != nil {
+		setup(cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLoadBalancer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range lb.Backends() {
+		b.SetAlive(true)
+	}
+	lb.rebuildSelectable()
+	t.Cleanup(func() { lb.Close() })
+	return lb
+}
+
+// do sends the request through the load balancer and returns the response
+func do(lb *LoadBalancer, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, r)
+	return rec
+}
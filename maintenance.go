@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//go:embed templates/maintenance
+var maintenanceFiles embed.FS
+
+// maintenanceAssetPrefix is the path the maintenance page's files are
+// served under, the page links its CSS and images from there
+const maintenanceAssetPrefix = "/_maintenance/"
+
+// maintenancePage is the page served while in maintenance mode and when
+// no backend can take a request, the files it links are served with it
+type maintenancePage struct {
+	assets map[string]*staticAsset
+	maxAge time.Duration
+	// enabled is set while in maintenance mode
+	enabled atomic.Bool
+}
+
+// staticAsset is a file read once when the load balancer starts
+type staticAsset struct {
+	body        []byte
+	contentType string
+	etag        string
+}
+
+// newMaintenancePage reads the files from the configured directory or, by
+// default, the embedded ones, index.html is the page
+func newMaintenancePage(cfg *MaintenanceConfig) (*maintenancePage, error) {
+	var fsys fs.FS
+	if cfg.Dir != "" {
+		fsys = os.DirFS(cfg.Dir)
+	} else {
+		fsys, _ = fs.Sub(maintenanceFiles, "templates/maintenance")
+	}
+	p := &maintenancePage{assets: make(map[string]*staticAsset), maxAge: cfg.MaxAge.Duration}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		ct := mime.TypeByExtension(path.Ext(name))
+		if ct == "" {
+			ct = http.DetectContentType(body)
+		}
+		sum := sha256.Sum256(body)
+		p.assets[name] = &staticAsset{body: body, contentType: ct, etag: `"` + hex.EncodeToString(sum[:8]) + `"`}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.assets["index.html"] == nil {
+		return nil, fmt.Errorf("no index.html")
+	}
+	p.enabled.Store(cfg.Enabled)
+	return p, nil
+}
+
+// serve answers requests for the page's files and, in maintenance mode,
+// every other request with the page, it reports whether it answered
+func (p *maintenancePage) serve(w http.ResponseWriter, r *http.Request) bool {
+	if name, ok := strings.CutPrefix(r.URL.Path, maintenanceAssetPrefix); ok {
+		if a := p.assets[name]; a != nil && name != "index.html" {
+			p.serveAsset(w, r, a)
+			return true
+		}
+	}
+	if !p.enabled.Load() {
+		return false
+	}
+	p.servePage(w, r, http.StatusServiceUnavailable)
+	return true
+}
+
+// serveAsset serves one of the page's files, clients may cache it for the
+// max age and revalidate it by its ETag after that
+func (p *maintenancePage) serveAsset(w http.ResponseWriter, r *http.Request, a *staticAsset) {
+	h := w.Header()
+	h.Set("ETag", a.etag)
+	h.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(p.maxAge.Seconds())))
+	if notModified(r, h) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", a.contentType)
+	h.Set("Content-Length", strconv.Itoa(len(a.body)))
+	if r.Method != http.MethodHead {
+		w.Write(a.body)
+	}
+}
+
+// servePage answers with the page and the given status, the page isn't
+// to be cached as it only stands in for the real response
+func (p *maintenancePage) servePage(w http.ResponseWriter, r *http.Request, status int) {
+	a := p.assets["index.html"]
+	h := w.Header()
+	h.Set("Content-Type", a.contentType)
+	h.Set("Content-Length", strconv.Itoa(len(a.body)))
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(a.body)
+	}
+}
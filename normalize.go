@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// normalizeRequest returns the request with its path cleaned for routing,
+// coalescing and the backend, the original request is left as it is
+func (lb *LoadBalancer) normalizeRequest(r *http.Request) *http.Request {
+	p := normalizePath(r.URL.Path, lb.cfg.TrailingSlash)
+	raw := r.URL.RawPath
+	if raw != "" {
+		raw = normalizePath(raw, lb.cfg.TrailingSlash)
+	}
+	if p == r.URL.Path && raw == r.URL.RawPath {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path, u.RawPath = p, raw
+	r2.URL = &u
+	return r2
+}
+
+// normalizePath collapses duplicate slashes and resolves . and .. segments,
+// a trailing slash is kept, removed with "strip" or added with "add". The
+// asterisk form of OPTIONS * isn't a path and is left alone.
+func normalizePath(p, trailingSlash string) string {
+	if p == "*" {
+		return p
+	}
+	slash := strings.HasSuffix(p, "/")
+	switch trailingSlash {
+	case "strip":
+		slash = false
+	case "add":
+		slash = true
+	}
+	p = path.Clean("/" + p)
+	if slash && p != "/" {
+		p += "/"
+	}
+	return p
+}
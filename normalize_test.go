@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		in, trailingSlash, want string
+	}{
+		{"//a/../b/", "", "/b/"},
+		{"//a/../b/", "strip", "/b"},
+		{"//a/../b", "add", "/b/"},
+		{"/a//b/./c/..", "", "/a/b"},
+		{"/../../a", "", "/a"},
+		{"a/b", "", "/a/b"},
+		{"/", "strip", "/"},
+		{"", "", "/"},
+		{"*", "add", "*"},
+	}
+	for _, tt := range tests {
+		if got := normalizePath(tt.in, tt.trailingSlash); got != tt.want {
+			t.Errorf("normalizePath(%q, %q) = %q, want %q", tt.in, tt.trailingSlash, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeRequest(t *testing.T) {
+	lb := &LoadBalancer{cfg: &Config{}}
+	r := httptest.NewRequest(http.MethodGet, "//a/../b/?q=1", nil)
+	if got := lb.normalizeRequest(r).URL.RequestURI(); got != "/b/?q=1" {
+		t.Fatalf("got %s, want /b/?q=1", got)
+	}
+	r = httptest.NewRequest(http.MethodOptions, "*", nil)
+	if got := lb.normalizeRequest(r); got != r {
+		t.Fatalf("OPTIONS * rewritten to %s", got.URL)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultOverrideHeader is the request header carrying an override token
+const defaultOverrideHeader = "X-LB-Override"
+
+// overrideClaims are the claims of an override token, it sends the
+// request to Backend or, without one, to Pool until Exp, a Unix time
+type overrideClaims struct {
+	Backend string `json:"backend"`
+	Pool    string `json:"pool"`
+	Exp     int64  `json:"exp"`
+}
+
+// overrideKey holds the backend a token sent the request to, nil if it
+// named a pool
+type overrideKey struct{}
+
+// overridden reports whether a token sent the request to a backend or pool
+func overridden(ctx context.Context) bool {
+	_, ok := ctx.Value(overrideKey{}).(*Backend)
+	return ok
+}
+
+// tokenOverride lets callers holding a token signed with the shared secret
+// send a request to a backend or pool of their choosing. Tokens are JWTs
+// signed with HS256, ones that don't verify, have expired or name a
+// backend that is down are ignored and the request is routed as usual.
+type tokenOverride struct {
+	header string
+	secret []byte
+	inner  Strategy
+}
+
+func newTokenOverride(cfg *OverrideConfig, inner Strategy) *tokenOverride {
+	header := cfg.Header
+	if header == "" {
+		header = defaultOverrideHeader
+	}
+	return &tokenOverride{header: header, secret: []byte(cfg.Secret), inner: inner}
+}
+
+// verify checks the token's signature and expiry and returns its claims
+func (o *tokenOverride) verify(token string, now time.Time) (*overrideClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	// the algorithm is fixed, a token can't pick a weaker one
+	if header.Alg != "HS256" {
+		return nil, errors.New("unsupported algorithm " + header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, o.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("bad signature")
+	}
+	var claims overrideClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.Exp == 0 || !now.Before(time.Unix(claims.Exp, 0)) {
+		return nil, errors.New("token expired")
+	}
+	return &claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// apply reads the request's token, a valid one moves the request to the
+// pool of the backend it names, which the strategy then picks, or to the
+// pool it names
+func (o *tokenOverride) apply(lb *LoadBalancer, r *http.Request, m *routeMatch) *http.Request {
+	token := r.Header.Get(o.header)
+	if token == "" {
+		return r
+	}
+	claims, err := o.verify(token, time.Now())
+	if err != nil {
+		return r
+	}
+	if claims.Backend != "" {
+		b := lb.backendByURL(claims.Backend)
+		if b == nil || !b.IsAlive() {
+			return r
+		}
+		m.pool = b.Pool
+		return r.WithContext(context.WithValue(r.Context(), overrideKey{}, b))
+	}
+	if claims.Pool != "" && len(lb.pool(claims.Pool)) > 0 {
+		m.pool = claims.Pool
+		return r.WithContext(context.WithValue(r.Context(), overrideKey{}, (*Backend)(nil)))
+	}
+	return r
+}
+
+func (o *tokenOverride) Next(backends []*Backend, r *http.Request) *Backend {
+	if b, _ := r.Context().Value(overrideKey{}).(*Backend); b != nil && b.Available() && slices.Contains(backends, b) {
+		return b
+	}
+	return o.inner.Next(backends, r)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testOverrideSecret = "0123456789abcdef0123456789abcdef"
+
+func signOverride(t *testing.T, claims overrideClaims) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(testOverrideSecret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// namedBackends start backends answering with their name after delay,
+// with a cacheable response, until failing is set
+func namedBackends(t *testing.T, failing *atomic.Bool, delay time.Duration, names ...string) []string {
+	var urls []string
+	for _, name := range names {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			if failing.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(srv.Close)
+		urls = append(urls, srv.URL)
+	}
+	return urls
+}
+
+func TestOverrideResponsesAreNotCached(t *testing.T) {
+	var failing atomic.Bool
+	urls := namedBackends(t, &failing, 0, "a", "b")
+	lb := newTestLoadBalancer(t, urls, func(cfg *Config) {
+		cfg.StaleIfError = &StaleIfErrorConfig{MaxStale: Duration{time.Minute}}
+		cfg.Override = &OverrideConfig{Secret: testOverrideSecret}
+	})
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set(defaultOverrideHeader, signOverride(t, overrideClaims{Backend: urls[1], Exp: time.Now().Add(time.Minute).Unix()}))
+	if rec := do(lb, r); rec.Body.String() != "b" {
+		t.Fatalf("got %q, want the overridden backend's answer", rec.Body)
+	}
+	failing.Store(true)
+	if rec := do(lb, httptest.NewRequest(http.MethodGet, "/page", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d %q, want no cached answer", rec.Code, rec.Body)
+	}
+}
+
+func TestPinnedRequestsAreNotCoalesced(t *testing.T) {
+	var failing atomic.Bool
+	urls := namedBackends(t, &failing, 100*time.Millisecond, "a", "b")
+	lb := newTestLoadBalancer(t, urls, func(cfg *Config) {
+		cfg.Coalesce = true
+		cfg.Pin = &PinConfig{}
+	})
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/page", nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			r.Header.Set(defaultPinHeader, u)
+			if rec := do(lb, r); rec.Body.String() != []string{"a", "b"}[i] {
+				t.Errorf("pinned to %s, got %q", u, rec.Body)
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+}
+
+func TestPinMatchesNormalizedURLs(t *testing.T) {
+	lb := newTestLoadBalancer(t, []string{"http://a.example:80", "http://b.example", "http://c.example"}, func(cfg *Config) {
+		cfg.Pin = &PinConfig{}
+	})
+	for _, pinned := range []string{"http://b.example", "http://B.example:80/", "HTTP://b.example/any/path"} {
+		// round-robin alone would spread these over every backend
+		for range 3 {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			r.Header.Set(defaultPinHeader, pinned)
+			if b := lb.NextBackend(r); b.URL.Host != "b.example" {
+				t.Fatalf("pinned to %s, got %s", pinned, b.URL)
+			}
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set(defaultPinHeader, "http://a.example/")
+	if b := lb.NextBackend(r); b.URL.Host != "a.example:80" {
+		t.Fatalf("pinned without the default port, got %s", b.URL)
+	}
+}
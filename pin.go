@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// defaultPinHeader is the request header naming the backend to pin to
+const defaultPinHeader = "X-LB-Backend"
+
+// debugPin sends requests from trusted clients to the backend named in the
+// pin header, requests whose backend is unknown or can't take them are left
+// to the inner strategy. The backend is looked up as the admin API looks
+// backends up, so the URL needn't be spelled as in the config.
+type debugPin struct {
+	header  string
+	trusted trustedNets
+	inner   Strategy
+	find    func(u string) *Backend
+}
+
+func newDebugPin(cfg *PinConfig, inner Strategy, find func(u string) *Backend) (*debugPin, error) {
+	s := &debugPin{header: cfg.Header, inner: inner, find: find}
+	if s.header == "" {
+		s.header = defaultPinHeader
+	}
+	trusted, err := newTrustedNets(cfg.TrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	s.trusted = trusted
+	return s, nil
+}
+
+// applies reports whether a trusted client pinned the request
+func (s *debugPin) applies(r *http.Request) bool {
+	return r.Header.Get(s.header) != "" && s.trusted.allows(r)
+}
+
+func (s *debugPin) Next(backends []*Backend, r *http.Request) *Backend {
+	if s.applies(r) {
+		if b := s.find(r.Header.Get(s.header)); b != nil && b.Available() && slices.Contains(backends, b) {
+			return b
+		}
+	}
+	return s.inner.Next(backends, r)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// drainPollInterval is how often a backend being removed is checked for idleness
+const drainPollInterval = 100 * time.Millisecond
+
+// errDuplicateBackend is returned when adding a backend that is already there
+var errDuplicateBackend = errors.New("duplicate backend")
+
+// Backends returns the backends the load balancer knows about, the slice
+// must not be modified
+func (lb *LoadBalancer) Backends() []*Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.backends
+}
+
+// pool returns the backends of the named pool, the slice must not be modified
+func (lb *LoadBalancer) pool(name string) []*Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.pools[name]
+}
+
+// candidates returns the selectable backends of the named pool, the slice
+// must not be modified
+func (lb *LoadBalancer) candidates(name string) []*Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.selectable[name]
+}
+
+// rebuildSelectable recomputes the selectable backends of every pool and
+// prunes the state kept for removed backends, it must be called whenever a
+// backend's health, drain state or weight changes
+func (lb *LoadBalancer) rebuildSelectable() {
+	lb.mu.Lock()
+	selectable := make(map[string][]*Backend, len(lb.pools))
+	keep := make(map[*Backend]bool)
+	for name, pool := range lb.pools {
+		var bs []*Backend
+		for _, b := range pool {
+			keep[b] = true
+			if b.IsAlive() && !b.Draining() && b.Weight() > 0 {
+				bs = append(bs, b)
+			}
+		}
+		selectable[name] = bs
+	}
+	lb.selectable = selectable
+	lb.mu.Unlock()
+	for _, p := range lb.pruners {
+		p.prune(keep)
+	}
+}
+
+// pruner is state kept per backend, such as a strategy's, prune drops the
+// state of the backends keep doesn't hold as they were removed
+type pruner interface {
+	prune(keep map[*Backend]bool)
+}
+
+// backendByURL returns the backend with the given URL, nil if there is
+// none or the URL doesn't parse, see FindBackend
+func (lb *LoadBalancer) backendByURL(u string) *Backend {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil
+	}
+	return lb.FindBackend(parsed)
+}
+
+// FindBackend returns the backend at the URL's host and port, nil if there
+// is none. Host names compare case-insensitively, a missing port is the
+// scheme's default, and the path is ignored. Schemes must match unless
+// backend_lookup_ignores_scheme is set.
+func (lb *LoadBalancer) FindBackend(u *url.URL) *Backend {
+	scheme, host := backendAddr(u)
+	for _, b := range lb.Backends() {
+		s, h := backendAddr(b.URL)
+		if h == host && (s == scheme || lb.cfg.BackendLookupIgnoresScheme) {
+			return b
+		}
+	}
+	return nil
+}
+
+// backendAddr returns the URL's scheme and its host and port normalized
+// for comparison
+func backendAddr(u *url.URL) (scheme, hostport string) {
+	scheme = strings.ToLower(u.Scheme)
+	port := u.Port()
+	if port == "" {
+		switch scheme {
+		case "https":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	return scheme, net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// AddBackend adds a backend at runtime and runs its first health check,
+// it joins the rotation if it passes. A backend at the same scheme, host
+// and port as one already there is a duplicate, rejected or merged by the
+// duplicate_backends policy as in the config: merging adds the weight to
+// the existing backend, which is returned. Backends added aren't part of
+// the pool state, a restart only brings back the configured ones.
+func (lb *LoadBalancer) AddBackend(ctx context.Context, bc BackendConfig) (*Backend, error) {
+	u, err := url.Parse(bc.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("backend %q: invalid url", bc.URL)
+	}
+	if err := validateBackend(bc); err != nil {
+		return nil, err
+	}
+	b, err := lb.newBackend(bc)
+	if err != nil {
+		return nil, err
+	}
+
+	key := stateKey(u)
+	lb.mu.Lock()
+	for _, existing := range lb.backends {
+		if stateKey(existing.URL) != key {
+			continue
+		}
+		removing := !slices.Contains(lb.pools[existing.Pool], existing)
+		lb.mu.Unlock()
+		switch {
+		case removing:
+			return nil, fmt.Errorf("%w: backend %s is still being removed", errDuplicateBackend, existing.URL)
+		case lb.cfg.DuplicateBackends != "merge":
+			return nil, fmt.Errorf("%w: backend %s is already there as %s", errDuplicateBackend, bc.URL, existing.URL)
+		case bc.Pool != existing.Pool:
+			return nil, fmt.Errorf("%w: backend %s is in pool %q, not %q", errDuplicateBackend, existing.URL, existing.Pool, bc.Pool)
+		}
+		w := existing.Weight() + backendWeight(bc)
+		existing.SetWeight(w)
+		lb.rebuildSelectable()
+		if lb.state != nil {
+			lb.state.setWeight(existing.URL, w)
+		}
+		fmt.Printf("server %s merged into %s, weight set to %d\n", bc.URL, existing.URL, w)
+		return existing, nil
+	}
+	// the slices are replaced rather than edited, callers may still hold the old ones
+	lb.backends = append(slices.Clone(lb.backends), b)
+	lb.pools[b.Pool] = append(slices.Clone(lb.pools[b.Pool]), b)
+	lb.mu.Unlock()
+	if lb.state != nil {
+		lb.state.add(b.URL)
+	}
+	fmt.Printf("server %s added to pool %q\n", b.URL, b.Pool)
+	lb.checkBackends(ctx, []*Backend{b})
+	return b, nil
+}
+
+// RemoveBackendGraceful takes the backend out of rotation, waits up to timeout
+// for its in-flight requests to finish and then drops it, closing its idle
+// connections
+func (lb *LoadBalancer) RemoveBackendGraceful(u string, timeout time.Duration) error {
+	b, err := lb.takeOutOfRotation(u)
+	if err != nil {
+		return err
+	}
+	lb.finishRemoval(b, timeout)
+	return nil
+}
+
+// takeOutOfRotation starts the removal of a backend, it gets no new
+// requests once this returns
+func (lb *LoadBalancer) takeOutOfRotation(u string) (*Backend, error) {
+	b := lb.backendByURL(u)
+	if b == nil {
+		return nil, fmt.Errorf("backend %s not found", u)
+	}
+	b.Drain()
+	// the slices are replaced rather than edited, callers may still hold the old ones
+	lb.mu.Lock()
+	lb.pools[b.Pool] = slices.DeleteFunc(slices.Clone(lb.pools[b.Pool]), func(p *Backend) bool { return p == b })
+	lb.mu.Unlock()
+	lb.rebuildSelectable()
+	// recorded now so a restart during the wait doesn't bring it back
+	if lb.state != nil {
+		lb.state.remove(b.URL)
+	}
+	return b, nil
+}
+
+// finishRemoval waits up to timeout for the in-flight requests of a backend
+// taken out of rotation, the load balancer closing ends the wait, then
+// drops the backend
+func (lb *LoadBalancer) finishRemoval(b *Backend, timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(drainPollInterval)
+	defer tick.Stop()
+wait:
+	for b.ActiveConns() > 0 {
+		select {
+		case <-tick.C:
+		case <-deadline.C:
+			break wait
+		case <-lb.ctx.Done():
+			break wait
+		}
+	}
+	if n := b.ActiveConns(); n > 0 {
+		fmt.Printf("server %s removed with %d requests in flight\n", b.URL, n)
+	}
+
+	lb.mu.Lock()
+	lb.backends = slices.DeleteFunc(slices.Clone(lb.backends), func(p *Backend) bool { return p == b })
+	lb.mu.Unlock()
+	b.closeIdleConnections()
+	fmt.Printf("server %s removed\n", b.URL)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// BenchmarkNextBackendMostlyDead selects among 5000 backends of which 90%
+// are dead, selection only walks the alive ones
+func BenchmarkNextBackendMostlyDead(b *testing.B) {
+	for _, strategy := range []string{"round-robin", "weighted-round-robin", "least-connections", "consistent-hash"} {
+		b.Run(strategy, func(b *testing.B) {
+			urls := make([]string, 5000)
+			for i := range urls {
+				urls[i] = fmt.Sprintf("http://10.0.%d.%d:8080", i/250, i%250)
+			}
+			lb := newTestLoadBalancer(b, urls, func(cfg *Config) { cfg.Strategy = strategy })
+			for i, be := range lb.Backends() {
+				be.SetAlive(i%10 == 0)
+			}
+			lb.rebuildSelectable()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for b.Loop() {
+				if lb.NextBackend(r) == nil {
+					b.Fatal("no backend")
+				}
+			}
+		})
+	}
+}
+
+func TestFindBackend(t *testing.T) {
+	urls := []string{"http://api.example:8080", "https://web.example", "http://plain.example/base"}
+	for _, tc := range []struct {
+		lookup       string
+		ignoreScheme bool
+		want         string
+	}{
+		{"http://api.example:8080", false, "http://api.example:8080"},
+		{"http://API.Example:8080/any/path", false, "http://api.example:8080"},
+		{"http://api.example", false, ""},
+		{"https://api.example:8080", false, ""},
+		{"https://api.example:8080", true, "http://api.example:8080"},
+		{"https://web.example:443", false, "https://web.example"},
+		{"http://web.example", false, ""},
+		{"http://web.example:443", true, "https://web.example"},
+		{"http://plain.example:80", false, "http://plain.example/base"},
+		{"http://other.example", false, ""},
+	} {
+		lb := newTestLoadBalancer(t, urls, func(cfg *Config) {
+			cfg.BackendLookupIgnoresScheme = tc.ignoreScheme
+		})
+		u, err := url.Parse(tc.lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if b := lb.FindBackend(u); b != nil {
+			got = b.URL.String()
+		}
+		if got != tc.want {
+			t.Errorf("FindBackend(%s) ignoring scheme %v = %q, want %q", tc.lookup, tc.ignoreScheme, got, tc.want)
+		}
+	}
+}
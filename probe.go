@@ -0,0 +1,346 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultProbeTimeout bounds a single probe when no timeout is configured
+const defaultProbeTimeout = 2 * time.Second
+
+// Prober checks one aspect of a backend's health, it returns nil if the backend passed
+type Prober interface {
+	Probe(ctx context.Context, u *url.URL) error
+}
+
+type probeTimeoutsKey struct{}
+
+// probeTimeouts bound the phases of the probes of a backend, connect the
+// dial and read the wait for the answer once connected, 0 leaves a phase
+// to the probe's timeout
+type probeTimeouts struct {
+	connect time.Duration
+	read    time.Duration
+}
+
+func withProbeTimeouts(ctx context.Context, t probeTimeouts) context.Context {
+	return context.WithValue(ctx, probeTimeoutsKey{}, t)
+}
+
+func probeTimeoutsFrom(ctx context.Context) probeTimeouts {
+	t, _ := ctx.Value(probeTimeoutsKey{}).(probeTimeouts)
+	return t
+}
+
+// probeDial dials with d, or with the connect timeout of the probe if it has one
+func probeDial(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if t := probeTimeoutsFrom(ctx).connect; t > 0 {
+			d2 := *d
+			d2.Timeout = t
+			return d2.DialContext(ctx, network, addr)
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// tcpProber passes backends that accept a TCP connection
+type tcpProber struct {
+	dialer *net.Dialer
+}
+
+func (p tcpProber) Probe(ctx context.Context, u *url.URL) error {
+	conn, err := probeDial(p.dialer)(ctx, "tcp", u.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return nil
+}
+
+// versionProber is a Prober that also reads the version the backend
+// reports, an empty version is none
+type versionProber interface {
+	ProbeVersion(ctx context.Context, u *url.URL) (string, error)
+}
+
+// maxProbeBody caps how much of a probe response is read for the version
+const maxProbeBody = 1 << 20
+
+// httpProber passes backends that answer a GET of the path with a 2xx
+// status, with a versionField it reads the backend's version from the
+// JSON response body
+type httpProber struct {
+	path         string
+	headers      map[string]string
+	versionField string
+	client       *http.Client
+}
+
+func (p httpProber) Probe(ctx context.Context, u *url.URL) error {
+	_, err := p.ProbeVersion(ctx, u)
+	return err
+}
+
+func (p httpProber) ProbeVersion(ctx context.Context, u *url.URL) (string, error) {
+	if read := probeTimeoutsFrom(ctx).read; read > 0 {
+		// the read timeout starts once connected, the dial has its own
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		var timer *time.Timer
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(httptrace.GotConnInfo) {
+				timer = time.AfterFunc(read, func() {
+					cancel(fmt.Errorf("no answer within the %s read timeout", read))
+				})
+			},
+		})
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+		version, err := p.probeVersion(ctx, u)
+		if cause := context.Cause(ctx); err != nil && cause != nil && cause != context.Canceled {
+			err = cause
+		}
+		return version, err
+	}
+	return p.probeVersion(ctx, u)
+}
+
+func (p httpProber) probeVersion(ctx context.Context, u *url.URL) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.JoinPath(p.path).String(), nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range p.headers {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("%s: status %d", req.URL.Path, resp.StatusCode)
+	}
+	if p.versionField == "" {
+		return "", nil
+	}
+	return jsonField(io.LimitReader(resp.Body, maxProbeBody), p.versionField), nil
+}
+
+// jsonField returns the field of a JSON object, "a.b" is field b of the
+// object in field a, it is empty if the body isn't JSON or lacks the field
+func jsonField(body io.Reader, field string) string {
+	var v any
+	if json.NewDecoder(body).Decode(&v) != nil {
+		return ""
+	}
+	for name := range strings.SplitSeq(field, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+		v = obj[name]
+	}
+	switch v := v.(type) {
+	case nil, map[string]any, []any:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// commandProber passes backends for which the command exits 0, the command
+// gets the backend URL in LB_BACKEND_URL
+type commandProber struct {
+	command []string
+	timeout time.Duration
+}
+
+func (p commandProber) Probe(ctx context.Context, u *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Env = append(os.Environ(), "LB_BACKEND_URL="+u.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if len(out) > 0 {
+			return fmt.Errorf("%s: %w: %s", p.command[0], err, out)
+		}
+		return fmt.Errorf("%s: %w", p.command[0], err)
+	}
+	return nil
+}
+
+// newProber creates a probe, network probes dial the way traffic does,
+// headers are sent with http probes, which verify https backends against
+// cas if not nil
+func newProber(cfg *Config, pc ProbeConfig, headers map[string]string, cas *x509.CertPool) (Prober, error) {
+	timeout := pc.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	if pc.VersionField != "" && pc.Type != "http" {
+		return nil, fmt.Errorf("version_field needs an http probe")
+	}
+	switch pc.Type {
+	case "", "tcp":
+		return tcpProber{dialer: newDialer(cfg, timeout)}, nil
+	case "http":
+		path := pc.Path
+		if path == "" {
+			path = "/healthz"
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = probeDial(newDialer(cfg, timeout))
+		if cas != nil {
+			t.TLSClientConfig = &tls.Config{RootCAs: cas}
+		}
+		return httpProber{path: path, headers: headers, versionField: pc.VersionField, client: &http.Client{Transport: t, Timeout: timeout}}, nil
+	case "command":
+		if len(pc.Command) == 0 {
+			return nil, fmt.Errorf("command probe without a command")
+		}
+		return commandProber{command: pc.Command, timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("unknown probe type %q", pc.Type)
+}
+
+// healthChecker runs every probe against a backend and combines the outcomes
+// by its policy: all must pass, any must pass, or the passing probes' share
+// of the total weight must reach the threshold
+type healthChecker struct {
+	probers   []Prober
+	weights   []float64
+	policy    string
+	threshold float64
+}
+
+var errNoProbeWeight = errors.New("no probe has any weight")
+
+// newHealthChecker creates the health checker for a pool, the settings the
+// pool leaves unset, or all of them if ph is nil, come from the global ones
+func newHealthChecker(cfg *Config, ph *PoolHealthConfig, cas *x509.CertPool) (*healthChecker, error) {
+	h := &healthChecker{policy: cfg.HealthPolicy, threshold: cfg.HealthThreshold}
+	probes := cfg.HealthChecks
+	headers := cfg.HealthCheckHeaders
+	if ph != nil {
+		if ph.Policy != "" {
+			h.policy, h.threshold = ph.Policy, ph.Threshold
+		}
+		if len(ph.Checks) > 0 {
+			probes = ph.Checks
+		}
+		if ph.Headers != nil {
+			headers = ph.Headers
+		}
+	}
+	if len(probes) == 0 {
+		probes = []ProbeConfig{{Type: "tcp"}}
+	}
+	for _, pc := range probes {
+		p, err := newProber(cfg, pc, headers, cas)
+		if err != nil {
+			return nil, err
+		}
+		weight := 1.0
+		if pc.Weight != nil {
+			weight = *pc.Weight
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("probe weight must not be negative")
+		}
+		h.probers = append(h.probers, p)
+		h.weights = append(h.weights, weight)
+	}
+	if h.policy == "weighted" && !slices.ContainsFunc(h.weights, func(w float64) bool { return w > 0 }) {
+		return nil, fmt.Errorf("weighted health_policy needs a probe with a positive weight")
+	}
+	return h, nil
+}
+
+// closeIdleConnections closes the connections http probes keep open
+func (h *healthChecker) closeIdleConnections() {
+	for _, p := range h.probers {
+		if hp, ok := p.(httpProber); ok {
+			hp.client.CloseIdleConnections()
+		}
+	}
+}
+
+// check probes the backend concurrently with every prober and returns nil
+// if the outcomes add up to a healthy backend, along with the version read
+// by the first of the probers that read one
+func (h *healthChecker) check(ctx context.Context, u *url.URL) (string, error) {
+	errs := make([]error, len(h.probers))
+	versions := make([]string, len(h.probers))
+	done := make(chan struct{})
+	for i, p := range h.probers {
+		go func() {
+			if vp, ok := p.(versionProber); ok {
+				versions[i], errs[i] = vp.ProbeVersion(ctx, u)
+			} else {
+				errs[i] = p.Probe(ctx, u)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for range h.probers {
+		<-done
+	}
+
+	var passed, total float64
+	npassed := 0
+	for i, err := range errs {
+		total += h.weights[i]
+		if err == nil {
+			passed += h.weights[i]
+			npassed++
+		}
+	}
+	failed := errors.Join(errs...)
+	version := cmp.Or(versions...)
+	switch h.policy {
+	case "any":
+		if npassed > 0 {
+			return version, nil
+		}
+	case "weighted":
+		// no weight at all is nothing vouching for the backend
+		if total > 0 && passed/total >= h.threshold {
+			return version, nil
+		}
+		if failed == nil {
+			failed = errNoProbeWeight
+		}
+	default:
+		if failed == nil {
+			return version, nil
+		}
+	}
+	return version, failed
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+type proberFunc func(ctx context.Context, u *url.URL) error
+
+func (f proberFunc) Probe(ctx context.Context, u *url.URL) error {
+	return f(ctx, u)
+}
+
+func TestWeightedHealthPolicy(t *testing.T) {
+	pass := proberFunc(func(context.Context, *url.URL) error { return nil })
+	fail := proberFunc(func(context.Context, *url.URL) error { return errors.New("down") })
+	u, _ := url.Parse("http://a.example")
+	for _, tc := range []struct {
+		name    string
+		probers []Prober
+		weights []float64
+		healthy bool
+	}{
+		{"over threshold", []Prober{pass, fail}, []float64{3, 1}, true},
+		{"under threshold", []Prober{pass, fail}, []float64{1, 3}, false},
+		{"no weight", []Prober{pass, pass}, []float64{0, 0}, false},
+	} {
+		h := &healthChecker{probers: tc.probers, weights: tc.weights, policy: "weighted", threshold: 0.5}
+		if _, err := h.check(context.Background(), u); (err == nil) != tc.healthy {
+			t.Errorf("%s: error %v, want healthy %v", tc.name, err, tc.healthy)
+		}
+	}
+}
+
+func TestWeightedHealthPolicyNeedsWeight(t *testing.T) {
+	zero := 0.0
+	cfg := defaultConfig()
+	cfg.HealthPolicy, cfg.HealthThreshold = "weighted", 0.5
+	cfg.HealthChecks = []ProbeConfig{{Type: "tcp", Weight: &zero}}
+	if _, err := newHealthChecker(cfg, nil, nil); err == nil {
+		t.Error("probes without weight accepted")
+	}
+}
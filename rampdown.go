@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// rampDown is a backend's weight ramp-down, from its full weight at start
+// to 0 at end
+type rampDown struct {
+	start time.Time
+	end   time.Time
+}
+
+// rampFactor returns the share of its weight the backend gets while
+// ramping down, 1 when it isn't
+func (b *Backend) rampFactor() float64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.ramp == nil {
+		return 1
+	}
+	left := time.Until(b.ramp.end)
+	if left <= 0 {
+		return 0
+	}
+	return float64(left) / float64(b.ramp.end.Sub(b.ramp.start))
+}
+
+// rampRemaining returns how long the ramp-down has left, 0 if none is
+// running, b.mu must be held
+func (b *Backend) rampRemaining() time.Duration {
+	if b.ramp == nil {
+		return 0
+	}
+	return max(time.Until(b.ramp.end), 0)
+}
+
+// cancelRampDown stops a running ramp-down, the backend keeps its weight
+func (b *Backend) cancelRampDown() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ramp = nil
+}
+
+// DrainGracefully ramps the backend's effective weight down to 0 over the
+// duration, so its share of new requests tapers off rather than stopping
+// at once, then sets its weight to 0, which keeps it known and health
+// checked but out of rotation. Weighted round-robin follows the ramp,
+// other strategies only see the final weight. Setting the weight through
+// the admin API cancels the ramp.
+func (lb *LoadBalancer) DrainGracefully(u string, d time.Duration) error {
+	b := lb.backendByURL(u)
+	if b == nil {
+		return fmt.Errorf("backend %s not found", u)
+	}
+	if d <= 0 {
+		return fmt.Errorf("ramp-down duration must be positive")
+	}
+	now := time.Now()
+	ramp := &rampDown{start: now, end: now.Add(d)}
+	b.mu.Lock()
+	b.ramp = ramp
+	b.mu.Unlock()
+	if lb.state != nil {
+		lb.state.drain(b.URL)
+	}
+	fmt.Printf("server %s ramping down over %s\n", b.URL, d)
+
+	time.AfterFunc(d, func() {
+		b.mu.Lock()
+		if b.ramp != ramp {
+			// canceled or replaced by another ramp-down
+			b.mu.Unlock()
+			return
+		}
+		b.ramp = nil
+		b.weight = 0
+		b.mu.Unlock()
+		lb.rebuildSelectable()
+		if lb.state != nil {
+			lb.state.setWeight(b.URL, 0)
+		}
+		fmt.Printf("server %s ramped down, weight set to 0\n", b.URL)
+	})
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteLocation points a Location header that names a backend, or a
+// host in redirect_hosts, at the load balancer instead, so clients aren't
+// sent to an address only the load balancer can reach. Relative
+// locations already resolve against the load balancer and are left alone.
+func (lb *LoadBalancer) rewriteLocation(resp *http.Response) {
+	if !lb.cfg.RewriteRedirects && len(lb.cfg.RedirectHosts) == 0 {
+		return
+	}
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return
+	}
+	u, err := url.Parse(loc)
+	if err != nil || u.Host == "" {
+		return
+	}
+	if u.Scheme == "" {
+		// protocol relative, the client would use the scheme it came in on
+		u.Scheme = requestScheme(resp.Request)
+	}
+	switch public, ok := lb.cfg.RedirectHosts[strings.ToLower(u.Host)]; {
+	case ok:
+		pu, err := url.Parse(public)
+		if err != nil {
+			return
+		}
+		u.Scheme, u.Host = pu.Scheme, pu.Host
+	case lb.cfg.RewriteRedirects && lb.FindBackend(u) != nil:
+		u.Scheme, u.Host = requestScheme(resp.Request), resp.Request.Host
+	default:
+		return
+	}
+	resp.Header.Set("Location", u.String())
+}
+
+// requestScheme is the scheme the client reached the load balancer on
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// withRequestID makes sure the request carries an ID in the configured
+// format before it is forwarded and returns it, for traceparent the ID is
+// the trace ID. Valid IDs from the client are passed on as they are.
+func (lb *LoadBalancer) withRequestID(w http.ResponseWriter, r *http.Request) (*http.Request, string) {
+	switch lb.cfg.RequestID {
+	case "x-request-id":
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = randomHex(16)
+			r = withHeader(r, "X-Request-Id", id)
+		}
+		w.Header().Set("X-Request-Id", id)
+		return r, id
+	case "traceparent":
+		if traceID, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+			return r, traceID
+		}
+		// without a valid parent the trace state means nothing, the
+		// sampled flag is set so backends sampling by their parent record
+		// the trace the load balancer started
+		traceID := randomHex(16)
+		r = withHeader(r, "Traceparent", "00-"+traceID+"-"+randomHex(8)+"-01")
+		r.Header.Del("Tracestate")
+		return r, traceID
+	}
+	return r, ""
+}
+
+// withHeader returns a copy of the request with the header set, the
+// original's headers are left alone
+func withHeader(r *http.Request, name, value string) *http.Request {
+	r2 := r.WithContext(r.Context())
+	r2.Header = r.Header.Clone()
+	r2.Header.Set(name, value)
+	return r2
+}
+
+// parseTraceparent returns the trace ID of a W3C traceparent header,
+// "version-traceid-parentid-flags" in lowercase hex. Versions after 00 may
+// add fields after the flags.
+func parseTraceparent(v string) (string, bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 {
+		return "", false
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" || version == "00" && len(parts) != 4 {
+		return "", false
+	}
+	if !isLowerHex(traceID, 32) || !isLowerHex(parentID, 16) || !isLowerHex(flags, 2) {
+		return "", false
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", false
+	}
+	return traceID, true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes in hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
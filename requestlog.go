@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestRecord is a request kept in the request log
+type RequestRecord struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Host   string    `json:"host"`
+	Path   string    `json:"path"`
+	// Route is the name of the route the request matched
+	Route string `json:"route"`
+	// Backend is empty when no backend was picked or the response was shared
+	Backend   string   `json:"backend,omitempty"`
+	Status    int      `json:"status"`
+	Bytes     int64    `json:"bytes"`
+	Latency   Duration `json:"latency"`
+	Client    string   `json:"client"`
+	UserAgent string   `json:"user_agent"`
+	// Variant is the A/B variant the request was sent to and Bucket the
+	// client's bucket, unset if the route has no split
+	Variant string `json:"variant,omitempty"`
+	Bucket  *int   `json:"bucket,omitempty"`
+	// RequestID is the request's ID, the trace ID for traceparent, empty
+	// if request IDs are disabled
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// requestLog is a ring buffer holding the last requests for triage
+type requestLog struct {
+	mu      sync.Mutex
+	records []RequestRecord
+	next    int
+	full    bool
+}
+
+func newRequestLog(size int) *requestLog {
+	return &requestLog{records: make([]RequestRecord, size)}
+}
+
+func (l *requestLog) add(rec RequestRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records[l.next] = rec
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// snapshot returns the logged requests, oldest first
+func (l *requestLog) snapshot() []RequestRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]RequestRecord(nil), l.records[:l.next]...)
+	}
+	return append(append([]RequestRecord(nil), l.records[l.next:]...), l.records[:l.next]...)
+}
+
+// servedBy is filled in by the proxy with the backend that got the request
+type servedBy struct {
+	backend atomic.Pointer[Backend]
+}
+
+// contextKey is the type of the context keys the package exports
+type contextKey struct {
+	name string
+}
+
+// BackendContextKey is the request context key under which the load
+// balancer keeps track of the backend serving the request, see
+// BackendFromContext and WithBackendSlot
+var BackendContextKey = &contextKey{"backend"}
+
+func servedByFrom(ctx context.Context) *servedBy {
+	s, _ := ctx.Value(BackendContextKey).(*servedBy)
+	return s
+}
+
+// BackendFromContext returns the backend picked for the request the
+// context belongs to, nil if none was picked yet or the response came
+// from a coalesced request
+func BackendFromContext(ctx context.Context) *Backend {
+	if s := servedByFrom(ctx); s != nil {
+		return s.backend.Load()
+	}
+	return nil
+}
+
+// WithBackendSlot prepares ctx to learn the backend picked for a request,
+// middleware wrapping the load balancer passes the request on with it
+// and reads BackendFromContext once the load balancer returns
+func WithBackendSlot(ctx context.Context) context.Context {
+	if servedByFrom(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, BackendContextKey, &servedBy{})
+}
+
+// withServedBy makes sure the request carries a servedBy for the proxy to
+// fill in, reusing one middleware added
+func withServedBy(r *http.Request) (*http.Request, *servedBy) {
+	if s := servedByFrom(r.Context()); s != nil {
+		return r, s
+	}
+	s := &servedBy{}
+	return r.WithContext(context.WithValue(r.Context(), BackendContextKey, s)), s
+}
+
+// newRequestRecord describes a request served by the load balancer
+func newRequestRecord(r *http.Request, s *servedBy, sw *statusWriter, start time.Time) RequestRecord {
+	rec := RequestRecord{
+		Time:      start,
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		Route:     routeFrom(r.Context()).name,
+		Status:    sw.status,
+		Bytes:     sw.bytes,
+		Latency:   Duration{time.Since(start)},
+		Client:    clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if b := s.backend.Load(); b != nil {
+		rec.Backend = b.URL.String()
+	}
+	if m := routeFrom(r.Context()); m.bucket >= 0 {
+		rec.Variant = m.variant
+		rec.Bucket = &m.bucket
+	}
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	return rec
+}
+
+// statusWriter remembers the status code and counts the body bytes of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	// 1xx responses are informational, the final status comes later
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the flusher and hijacker
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// silentWriter fails the test if anything is written to it
+type silentWriter struct {
+	t      *testing.T
+	header http.Header
+}
+
+func (w *silentWriter) Header() http.Header { return w.header }
+
+func (w *silentWriter) Write(p []byte) (int, error) {
+	w.t.Errorf("wrote %q to a client that went away", p)
+	return len(p), nil
+}
+
+func (w *silentWriter) WriteHeader(status int) {
+	w.t.Errorf("wrote status %d to a client that went away", status)
+}
+
+func TestClientCancelIsLoggedNotWritten(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	lb := newTestLoadBalancer(t, []string{backend.URL}, func(cfg *Config) {
+		cfg.DebugBufferSize = 10
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	lb.ServeHTTP(&silentWriter{t: t, header: make(http.Header)}, r)
+
+	recs := lb.requestLog.snapshot()
+	if len(recs) != 1 || recs[0].Status != statusClientClosedRequest {
+		t.Fatalf("request log %+v, want one request with status 499", recs)
+	}
+	if n := lb.Backends()[0].clientCancels.Load(); n != 1 {
+		t.Errorf("%d client cancels counted, want 1", n)
+	}
+}
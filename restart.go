@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// environment variables a restarting process hands its sockets down in,
+// LB_LISTEN_FDS names the listeners passed as fds 3 and up and LB_READY_FD
+// is the pipe the new process reports it is serving on
+const (
+	listenFDsEnv = "LB_LISTEN_FDS"
+	readyFDEnv   = "LB_READY_FD"
+)
+
+// upgradeTimeout is how long a new process gets to start serving
+const upgradeTimeout = 30 * time.Second
+
+// upgrader hands the listening sockets over to a new process so the binary
+// can be replaced without refusing connections, the old process stops
+// accepting once the new one is serving and drains what it has
+type upgrader struct {
+	inherited map[string]net.Listener
+	ready     *os.File
+	names     []string
+	listeners []net.Listener
+}
+
+// newUpgrader picks up the sockets a previous process passed down, if any
+func newUpgrader() (*upgrader, error) {
+	u := &upgrader{inherited: make(map[string]net.Listener)}
+	names := os.Getenv(listenFDsEnv)
+	if names == "" {
+		return u, nil
+	}
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %s: %w", name, err)
+		}
+		u.inherited[name] = ln
+	}
+	if fd, err := strconv.Atoi(os.Getenv(readyFDEnv)); err == nil {
+		u.ready = os.NewFile(uintptr(fd), "ready")
+	}
+	// our own children get the variables set afresh
+	os.Unsetenv(listenFDsEnv)
+	os.Unsetenv(readyFDEnv)
+	return u, nil
+}
+
+// listen returns the named listener passed down by the previous process or
+// opens a new one on addr
+func (u *upgrader) listen(name, addr string) (net.Listener, error) {
+	ln, ok := u.inherited[name]
+	if !ok {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	u.names = append(u.names, name)
+	u.listeners = append(u.listeners, ln)
+	return ln, nil
+}
+
+// serving tells the previous process, if any, that it can stop accepting,
+// inherited listeners that weren't asked for are closed
+func (u *upgrader) serving() {
+	for name, ln := range u.inherited {
+		if !slices.Contains(u.names, name) {
+			ln.Close()
+		}
+	}
+	if u.ready != nil {
+		u.ready.Write([]byte{1})
+		u.ready.Close()
+		u.ready = nil
+	}
+}
+
+// upgrade starts the binary again with the listeners and waits until the new
+// process is serving, the caller should then shut its servers down
+func (u *upgrader) upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range u.listeners {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s can't be handed over", ln.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		listenFDsEnv+"="+strings.Join(u.names, ","),
+		readyFDEnv+"="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("new process did not start serving: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// attempt is one try at forwarding a request, when retrying is allowed the
+// error handler leaves a retryable error in err instead of answering
+type attempt struct {
+	canRetry bool
+	err      error
+}
+
+type attemptKey struct{}
+
+func withAttempt(ctx context.Context, a *attempt) context.Context {
+	return context.WithValue(ctx, attemptKey{}, a)
+}
+
+func attemptFrom(ctx context.Context) *attempt {
+	a, _ := ctx.Value(attemptKey{}).(*attempt)
+	return a
+}
+
+// retryable reports whether a request that failed with err can safely be
+// sent to another backend. Failing to connect means the backend never saw
+// the request, a reset before the response means it may have, so that is
+// only retried for idempotent methods. Requests with a body are never
+// retried as the body was handed to the failed attempt.
+func retryable(err error, r *http.Request) bool {
+	if r.ContentLength != 0 || r.Context().Err() != nil {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return false
+}
+
+// retryBackoff waits before the given retry, exponentially longer from
+// base up to max with the jitter fraction of the wait randomized, the
+// wait ends early if ctx is done and never runs past its deadline
+func retryBackoff(ctx context.Context, cfg *RetryBackoffConfig, retry int) {
+	d := min(cfg.Base.Duration<<(retry-1), cfg.Max.Duration)
+	if d <= 0 {
+		// shifted past the range of a duration
+		d = cfg.Max.Duration
+	}
+	d -= time.Duration(rand.Float64() * cfg.Jitter * float64(d))
+	if deadline, ok := ctx.Deadline(); ok {
+		d = min(d, time.Until(deadline))
+	}
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// retryBudgetBuckets is how many buckets the retry budget's window is
+// split in, counts leave the window a bucket at a time
+const retryBudgetBuckets = 10
+
+// retryBudget caps retries at a share of the requests over a rolling
+// window so a partial outage doesn't turn into a retry storm, once it is
+// spent failed requests are answered rather than retried. MinRetries are
+// allowed in any window so quiet pools can still fail over.
+type retryBudget struct {
+	ratio      float64
+	minRetries uint64
+	bucketLen  time.Duration
+	mu         sync.Mutex
+	requests   [retryBudgetBuckets]uint64
+	retries    [retryBudgetBuckets]uint64
+	// head is the bucket counting now, it started at headStart
+	head      int
+	headStart time.Time
+	// denied counts the retries the budget refused
+	denied atomic.Uint64
+}
+
+func newRetryBudget(cfg *RetryBudgetConfig) *retryBudget {
+	return &retryBudget{
+		ratio:      cfg.Ratio,
+		minRetries: uint64(cfg.MinRetries),
+		bucketLen:  cfg.Window.Duration / retryBudgetBuckets,
+		headStart:  time.Now(),
+	}
+}
+
+// advance moves the head to the bucket for now, clearing the buckets
+// that left the window, mu must be held
+func (rb *retryBudget) advance(now time.Time) {
+	for i := 0; i < retryBudgetBuckets && now.Sub(rb.headStart) >= rb.bucketLen; i++ {
+		rb.head = (rb.head + 1) % retryBudgetBuckets
+		rb.requests[rb.head], rb.retries[rb.head] = 0, 0
+		rb.headStart = rb.headStart.Add(rb.bucketLen)
+	}
+	if now.Sub(rb.headStart) >= rb.bucketLen {
+		// idle for longer than the window, every bucket is clear
+		rb.headStart = now
+	}
+}
+
+// totals returns the requests and retries in the window, mu must be held
+func (rb *retryBudget) totals() (requests, retries uint64) {
+	for i := range retryBudgetBuckets {
+		requests += rb.requests[i]
+		retries += rb.retries[i]
+	}
+	return requests, retries
+}
+
+// request counts a request coming in
+func (rb *retryBudget) request() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.advance(time.Now())
+	rb.requests[rb.head]++
+}
+
+// spend takes a retry out of the budget, it fails if none is left
+func (rb *retryBudget) spend() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.advance(time.Now())
+	requests, retries := rb.totals()
+	if retries >= rb.minRetries && float64(retries+1) > rb.ratio*float64(requests) {
+		rb.denied.Add(1)
+		return false
+	}
+	rb.retries[rb.head]++
+	return true
+}
+
+// currentRatio returns the retries per request over the window
+func (rb *retryBudget) currentRatio() float64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.advance(time.Now())
+	requests, retries := rb.totals()
+	if requests == 0 {
+		return 0
+	}
+	return float64(retries) / float64(requests)
+}
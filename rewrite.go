@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+)
+
+// defaultRewriteContentTypes are the media types rewritten when no list is configured
+var defaultRewriteContentTypes = []string{"text/html", "text/plain", "text/css", "application/javascript", "application/json"}
+
+// rewriteBody applies the configured replacements to the response body as it
+// is streamed, the response goes out chunked since its length is unknown up
+// front, gzip bodies are decompressed and compressed again, other encodings
+// and content types are left untouched
+func (lb *LoadBalancer) rewriteBody(resp *http.Response) error {
+	rw := lb.cfg.Rewrite
+	if rw == nil || resp.Request.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	types := rw.ContentTypes
+	if len(types) == 0 {
+		types = defaultRewriteContentTypes
+	}
+	if !slices.Contains(types, mediaType) {
+		return nil
+	}
+
+	switch resp.Header.Get("Content-Encoding") {
+	case "":
+		resp.Body = newRewriteReader(resp.Body, rw.Rules)
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		resp.Body = gzipBody(newRewriteReader(readCloser{zr, resp.Body}, rw.Rules))
+	default:
+		return nil
+	}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// readCloser pairs a reader with the closer of the stream under it
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// gzipBody compresses the body as it is read
+func gzipBody(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, body)
+		if err == nil {
+			err = zw.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// rewriteReader replaces strings in a stream, input that could be the start
+// of a match is held back until enough of it arrived to tell, rules are
+// tried in order at each position
+type rewriteReader struct {
+	src     io.ReadCloser
+	rules   []RewriteRule
+	maxFrom int
+	buf     []byte
+	in      []byte
+	out     []byte
+	eof     bool
+}
+
+func newRewriteReader(src io.ReadCloser, rules []RewriteRule) *rewriteReader {
+	r := &rewriteReader{src: src, rules: rules, buf: make([]byte, 32<<10)}
+	for _, rule := range rules {
+		r.maxFrom = max(r.maxFrom, len(rule.From))
+	}
+	return r
+}
+
+func (r *rewriteReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		n, err := r.src.Read(r.buf)
+		r.in = append(r.in, r.buf[:n]...)
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		r.replace()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// replace moves the input that can be decided on to the output
+func (r *rewriteReader) replace() {
+	i := 0
+next:
+	for i < len(r.in) {
+		if !r.eof && len(r.in)-i < r.maxFrom {
+			break
+		}
+		for _, rule := range r.rules {
+			if bytes.HasPrefix(r.in[i:], []byte(rule.From)) {
+				r.out = append(r.out, rule.To...)
+				i += len(rule.From)
+				continue next
+			}
+		}
+		r.out = append(r.out, r.in[i])
+		i++
+	}
+	r.in = append(r.in[:0], r.in[i:]...)
+}
+
+func (r *rewriteReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultRoute names the requests no route matched
+const defaultRoute = "default"
+
+// routeMatch is the routing decision for a request, made once when it comes in
+type routeMatch struct {
+	name  string
+	pool  string
+	route *RouteConfig
+	// bucket is the A/B bucket the client is in, -1 if the route has no
+	// split or the client no identifier, variant the variant covering it
+	bucket  int
+	variant string
+}
+
+type routeKey struct{}
+
+func routeFrom(ctx context.Context) *routeMatch {
+	m, _ := ctx.Value(routeKey{}).(*routeMatch)
+	return m
+}
+
+// matchRoute routes the request and keeps the decision in its context
+func (lb *LoadBalancer) matchRoute(r *http.Request) (*http.Request, *routeMatch) {
+	m := lb.routeFor(r)
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, m)), m
+}
+
+// routeName is the route's name, falling back to its pool's
+func routeName(route *RouteConfig) string {
+	switch {
+	case route == nil:
+		return defaultRoute
+	case route.Name != "":
+		return route.Name
+	case route.Pool != "":
+		return route.Pool
+	}
+	return defaultRoute
+}
+
+// routeCounters counts the requests a route served
+type routeCounters struct {
+	mu       sync.Mutex
+	requests uint64
+	// errors are the requests answered with a 5xx status
+	errors uint64
+	// latency is the moving average of the response time
+	latency time.Duration
+}
+
+// routeStats holds the counters of every route, the routes are fixed
+// by the config so the map is only read once built
+type routeStats struct {
+	names  []string
+	routes map[string]*routeCounters
+}
+
+func newRouteStats(routes []RouteConfig) *routeStats {
+	m := &routeStats{routes: make(map[string]*routeCounters)}
+	for i := range routes {
+		m.add(routeName(&routes[i]))
+	}
+	m.add(defaultRoute)
+	return m
+}
+
+func (m *routeStats) add(name string) {
+	if _, ok := m.routes[name]; !ok {
+		m.names = append(m.names, name)
+		m.routes[name] = &routeCounters{}
+	}
+}
+
+// observe counts a request the route answered with status
+func (m *routeStats) observe(name string, status int, elapsed time.Duration) {
+	c := m.routes[name]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	if status >= 500 {
+		c.errors++
+	}
+	if c.latency == 0 {
+		c.latency = elapsed
+		return
+	}
+	c.latency += time.Duration(latencySmoothing * float64(elapsed-c.latency))
+}
+
+// stats returns the routes' counters in config order, the default route last
+func (m *routeStats) stats() []RouteStats {
+	stats := make([]RouteStats, len(m.names))
+	for i, name := range m.names {
+		c := m.routes[name]
+		c.mu.Lock()
+		stats[i] = RouteStats{Name: name, Requests: c.requests, Errors: c.errors, Latency: Duration{c.latency}}
+		c.mu.Unlock()
+	}
+	return stats
+}
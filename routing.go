@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// poolFor returns the name of the pool that should serve the request
+func (lb *LoadBalancer) poolFor(r *http.Request) string {
+	return lb.routeFor(r).pool
+}
+
+// routeFor decides which pool should serve the request and which route
+// picked it, if any. The routes are tried in the order they are
+// configured and the first match wins, then the TLS server name is looked
+// up, requests nothing matches go to the default pool. A route's A/B
+// split may send the request to a variant's pool instead.
+func (lb *LoadBalancer) routeFor(r *http.Request) *routeMatch {
+	for i := range lb.cfg.Routes {
+		if route := &lb.cfg.Routes[i]; route.matches(r) {
+			m := &routeMatch{name: routeName(route), pool: route.Pool, route: route, bucket: -1}
+			if split := lb.splits[route]; split != nil {
+				if v, bucket, ok := split.assign(r); ok {
+					m.bucket = bucket
+					if v != nil {
+						m.pool, m.variant = v.Pool, v.Name
+					}
+				}
+			}
+			return m
+		}
+	}
+	pool := lb.cfg.DefaultPool
+	if r.TLS != nil && lb.cfg.TLS != nil {
+		if p, ok := sniPool(lb.cfg.TLS.SNIPools, r.TLS.ServerName); ok {
+			pool = p
+		}
+	}
+	return &routeMatch{name: defaultRoute, pool: pool, bucket: -1}
+}
+
+// matches reports whether the request meets every condition the route sets
+func (rc *RouteConfig) matches(r *http.Request) bool {
+	if rc.Host != "" && !hostMatches(rc.Host, r.Host) {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, rc.PathPrefix) {
+		return false
+	}
+	if len(rc.Query) > 0 {
+		query := r.URL.Query()
+		for name, want := range rc.Query {
+			values, ok := query[name]
+			if !ok {
+				return false
+			}
+			if want != "*" && !slices.Contains(values, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hostMatches compares a request host against a pattern, "*.example.com"
+// matches any single label subdomain
+func hostMatches(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		_, rest, ok := strings.Cut(host, ".")
+		return ok && rest == suffix
+	}
+	return host == pattern
+}
+
+// sniPool looks up the pool for a TLS server name, exact names win over wildcards
+func sniPool(pools map[string]string, serverName string) (string, bool) {
+	if serverName == "" {
+		return "", false
+	}
+	name := strings.ToLower(serverName)
+	if pool, ok := pools[name]; ok {
+		return pool, true
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		pool, ok := pools["*."+rest]
+		return pool, ok
+	}
+	return "", false
+}
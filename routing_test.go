@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// idBackend answers every request with its id
+func idBackend(t *testing.T, id string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(id))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSNIRoutesToPools(t *testing.T) {
+	def, a, b := idBackend(t, "default"), idBackend(t, "a"), idBackend(t, "b")
+	lb := newTestLoadBalancer(t, []string{def.URL, a.URL, b.URL}, func(cfg *Config) {
+		cfg.Backends[1].Pool = "a"
+		cfg.Backends[2].Pool = "b"
+		cfg.TLS = &TLSConfig{SNIPools: map[string]string{
+			"a.example.com":   "a",
+			"*.b.example.com": "b",
+		}}
+	})
+	front := httptest.NewTLSServer(lb)
+	defer front.Close()
+
+	for _, tc := range []struct{ serverName, want string }{
+		{"a.example.com", "a"},
+		{"A.Example.com", "a"},
+		{"api.b.example.com", "b"},
+		{"b.example.com", "default"},
+		{"other.example.com", "default"},
+	} {
+		tr := front.Client().Transport.(*http.Transport).Clone()
+		tr.TLSClientConfig = &tls.Config{ServerName: tc.serverName, InsecureSkipVerify: true}
+		resp, err := (&http.Client{Transport: tr}).Get(front.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+		if string(body) != tc.want {
+			t.Errorf("server name %s went to pool %q, want %q", tc.serverName, body, tc.want)
+		}
+	}
+}
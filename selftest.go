@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxSelfTestBody caps how much of a failed self-test response is reported
+const maxSelfTestBody = 512
+
+// SelfTestResult is the outcome of a request sent through the load balancer
+// as a client's would be
+type SelfTestResult struct {
+	OK      bool     `json:"ok"`
+	Path    string   `json:"path"`
+	Backend string   `json:"backend,omitempty"`
+	Status  int      `json:"status"`
+	Latency Duration `json:"latency"`
+	// Error is the start of the response body if the request failed
+	Error string `json:"error,omitempty"`
+}
+
+// SelfTest sends a GET of the self-test path through the whole request
+// path, routing, backend selection and proxying, and reports how it went,
+// any status below 500 passes
+func (lb *LoadBalancer) SelfTest(ctx context.Context) SelfTestResult {
+	res := SelfTestResult{Path: lb.cfg.SelfTestPath}
+	r, err := http.NewRequestWithContext(WithBackendSlot(ctx), http.MethodGet, lb.cfg.SelfTestPath, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	r.RemoteAddr = "127.0.0.1:0"
+	r.Header.Set("User-Agent", "lb-selftest")
+	if lb.cfg.SelfTestHost != "" {
+		r.Host = lb.cfg.SelfTestHost
+	}
+
+	w := &selfTestWriter{header: make(http.Header)}
+	start := time.Now()
+	lb.ServeHTTP(w, r)
+	res.Latency = Duration{time.Since(start)}
+	res.Status = w.status
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	if b := BackendFromContext(r.Context()); b != nil {
+		res.Backend = b.URL.String()
+	}
+	res.OK = res.Status < 500
+	if !res.OK {
+		res.Error = strings.TrimSpace(w.body.String())
+	}
+	return res
+}
+
+// selfTestWriter keeps the status and the start of the body of a self-test response
+type selfTestWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *selfTestWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *selfTestWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *selfTestWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if n := maxSelfTestBody - w.body.Len(); n > 0 {
+		w.body.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errShaperQueueFull = errors.New("rate queue full")
+	errShaperTimeout   = errors.New("rate queue wait too long")
+)
+
+// shaper is a leaky bucket releasing a backend's requests at most at its
+// rate, requests over it wait their turn in a bounded queue rather than
+// reaching the backend as a burst
+type shaper struct {
+	interval time.Duration
+	maxQueue int
+	timeout  time.Duration
+	mu       sync.Mutex
+	// next is when the next request may go, queued how many are waiting
+	next   time.Time
+	queued int
+}
+
+func newShaper(rate float64, maxQueue int, timeout time.Duration) *shaper {
+	return &shaper{interval: time.Duration(float64(time.Second) / rate), maxQueue: maxQueue, timeout: timeout}
+}
+
+// wait holds the request until its turn, it fails right away if the queue
+// is full or the turn is further off than the queue timeout
+func (s *shaper) wait(ctx context.Context) error {
+	now := time.Now()
+	s.mu.Lock()
+	slot := s.next
+	if slot.Before(now) {
+		slot = now
+	}
+	delay := slot.Sub(now)
+	if delay > 0 && s.queued >= s.maxQueue {
+		s.mu.Unlock()
+		return errShaperQueueFull
+	}
+	if delay > s.timeout {
+		s.mu.Unlock()
+		return errShaperTimeout
+	}
+	s.next = slot.Add(s.interval)
+	if delay <= 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	s.queued++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.queued--
+		s.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var errResponseTooLarge = errors.New("response body too large")
+
+// limitResponse enforces MaxResponseBytes, a response that announces a
+// larger body is refused so the client gets a 502, one whose body turns
+// out larger than it claimed is cut off once past the limit, at that
+// point the headers are out and the only thing left to do is abort
+func (lb *LoadBalancer) limitResponse(b *Backend, resp *http.Response) error {
+	limit := lb.cfg.MaxResponseBytes
+	if limit <= 0 || isGRPC(resp.Request) {
+		return nil
+	}
+	if resp.ContentLength > limit {
+		return fmt.Errorf("%w: %d bytes, limit is %d", errResponseTooLarge, resp.ContentLength, limit)
+	}
+	resp.Body = &limitedBody{src: resp.Body, left: limit, limit: limit, onExceed: func(err error) {
+		lb.errorLog.log(b.URL.String(), err)
+	}}
+	return nil
+}
+
+// limitedBody fails reads once more than limit bytes came through
+type limitedBody struct {
+	src      io.ReadCloser
+	left     int64
+	limit    int64
+	onExceed func(error)
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, errResponseTooLarge
+	}
+	// read one byte past the limit to tell a body of exactly limit bytes
+	// from a larger one
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.src.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		err = fmt.Errorf("%w: over %d bytes, aborted", errResponseTooLarge, l.limit)
+		l.onExceed(err)
+		return n + int(l.left), err
+	}
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.src.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var errSlowBody = errors.New("request body too slow")
+
+// limitBodyRate makes the request's body fail once the client sends it
+// slower than MinBodyRate, the read deadline of the client's connection
+// moves with the bytes that came in so a client that stalls altogether is
+// cut off too. The clock starts when the body is first read, time the
+// request spends in the load balancer before that isn't the client's.
+func (lb *LoadBalancer) limitBodyRate(w http.ResponseWriter, r *http.Request) *http.Request {
+	if lb.cfg.MinBodyRate <= 0 || r.Body == nil || r.Body == http.NoBody || isGRPC(r) {
+		return r
+	}
+	body := &slowBody{
+		src:   r.Body,
+		rc:    http.NewResponseController(w),
+		rate:  float64(lb.cfg.MinBodyRate),
+		grace: lb.cfg.MinBodyRateGrace.Duration,
+	}
+	r2 := r.WithContext(context.WithValue(r.Context(), slowBodyKey{}, body))
+	r2.Body = body
+	return r2
+}
+
+type slowBodyKey struct{}
+
+// bodyTooSlow reports whether the request's body was cut off for being
+// too slow. The stalled read cancels the request as well, so the proxy
+// may see the cancellation rather than the body's error.
+func bodyTooSlow(ctx context.Context) bool {
+	body, _ := ctx.Value(slowBodyKey{}).(*slowBody)
+	return body != nil && body.failed.Load()
+}
+
+// slowBody fails reads once fewer bytes came in than the rate asks for
+// the time since the first read, past the grace period
+type slowBody struct {
+	src   io.ReadCloser
+	rc    *http.ResponseController
+	rate  float64
+	grace time.Duration
+	start time.Time
+	read  int64
+	// deadline is the read deadline set on the client's connection
+	deadline time.Time
+	// failed is set once the body was cut off, it is read by the proxy
+	failed atomic.Bool
+}
+
+func (s *slowBody) Read(p []byte) (int, error) {
+	if s.start.IsZero() {
+		s.start = time.Now()
+		s.extendDeadline()
+	}
+	n, err := s.src.Read(p)
+	s.read += int64(n)
+	now := time.Now()
+	if err == io.EOF {
+		// the server takes over the connection's deadlines again
+		s.rc.SetReadDeadline(time.Time{})
+		return n, err
+	}
+	if err != nil && !now.Before(s.deadline) {
+		return n, s.tooSlow(now)
+	}
+	if elapsed := now.Sub(s.start); elapsed > s.grace && float64(s.read) < s.rate*elapsed.Seconds() {
+		return n, s.tooSlow(now)
+	}
+	if err == nil {
+		s.extendDeadline()
+	}
+	return n, err
+}
+
+// extendDeadline lets the client's connection wait until the bytes read
+// so far no longer keep up with the rate, the grace period at least,
+// writers that can't set deadlines rely on the checks after each read
+func (s *slowBody) extendDeadline() {
+	wait := max(s.grace, time.Duration(float64(s.read)/s.rate*float64(time.Second)))
+	s.deadline = s.start.Add(wait)
+	s.rc.SetReadDeadline(s.deadline)
+}
+
+func (s *slowBody) tooSlow(now time.Time) error {
+	s.failed.Store(true)
+	return fmt.Errorf("%w: %d bytes in %s, minimum is %g bytes/s", errSlowBody, s.read, now.Sub(s.start).Round(time.Millisecond), s.rate)
+}
+
+func (s *slowBody) Close() error {
+	return s.src.Close()
+}
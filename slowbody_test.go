@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func slowBodyServer(t *testing.T, delay time.Duration) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	t.Cleanup(backend.Close)
+	lb := newTestLoadBalancer(t, []string{backend.URL}, func(cfg *Config) {
+		cfg.MinBodyRate = 1000
+		cfg.MinBodyRateGrace = Duration{100 * time.Millisecond}
+	})
+	// stands in for time spent in the load balancer, such as a shaper queue
+	lb.Use(func(*http.Request) (int, error) {
+		time.Sleep(delay)
+		return 0, nil
+	})
+	srv := httptest.NewServer(lb)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSlowBodyClockStartsAtFirstRead(t *testing.T) {
+	srv := slowBodyServer(t, 300*time.Millisecond)
+	resp, err := http.Post(srv.URL, "text/plain", strings.NewReader(strings.Repeat("x", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200 for a client that sent its body at once", resp.StatusCode)
+	}
+}
+
+func TestSlowBodyCutsOffStalledClient(t *testing.T) {
+	srv := slowBodyServer(t, 0)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: lb\r\nContent-Length: 1000\r\n\r\nxxxxxxxxxx"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("status %d, want 408", resp.StatusCode)
+	}
+}
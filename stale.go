@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"container/list"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How HEAD requests use the stale cache
+const (
+	// headOff leaves HEAD requests out of the cache
+	headOff = "off"
+	// headStale answers HEAD requests from the cache when GET ones would be
+	headStale = "stale"
+	// headFresh also answers HEAD requests from fresh entries without
+	// asking a backend
+	headFresh = "fresh"
+)
+
+// staleWarning marks a response served from the stale cache
+const staleWarning = `110 - "Response is Stale"`
+
+// defaultCacheBypassHeader is the request header asking for a fresh response
+const defaultCacheBypassHeader = "X-Cache-Bypass"
+
+type staleKeyCtx struct{}
+
+type staleBypassCtx struct{}
+
+// staleCache keeps the last good response to cacheable GET and HEAD
+// requests so it can be served when the backends fail, with stale-if-error
+// semantics: a response may be served until its max-age plus its
+// stale-if-error have passed. The least recently stored entries are
+// evicted first.
+type staleCache struct {
+	maxStale     time.Duration
+	maxEntries   int
+	maxBodyBytes int64
+	// head is how HEAD requests use the cache, see StaleIfErrorConfig
+	head string
+	// storeImplicit keeps responses without a Cache-Control header too
+	storeImplicit bool
+	// bypassHeader set to true by a trusted client skips the cache reads
+	bypassHeader string
+	trusted      trustedNets
+	mu           sync.Mutex
+	entries      map[string]*list.Element
+	order        *list.List
+}
+
+type staleEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+	// head is set for entries kept from HEAD responses, they have no body
+	// and only answer HEAD requests
+	head bool
+	// freshUntil is when the response's max-age runs out, it can answer
+	// conditional requests till then
+	freshUntil time.Time
+	// expires is when the response may no longer be served
+	expires time.Time
+}
+
+func newStaleCache(cfg *StaleIfErrorConfig) (*staleCache, error) {
+	trusted, err := newTrustedNets(cfg.BypassTrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	c := &staleCache{
+		maxStale:      cfg.MaxStale.Duration,
+		maxEntries:    cfg.MaxEntries,
+		maxBodyBytes:  cfg.MaxBodyBytes,
+		head:          cfg.Head,
+		storeImplicit: cfg.StoreWithoutCacheControl,
+		bypassHeader:  cmp.Or(cfg.BypassHeader, defaultCacheBypassHeader),
+		trusted:       trusted,
+		entries:       make(map[string]*list.Element),
+		order:         list.New(),
+	}
+	return c, nil
+}
+
+// withKey marks a GET request, and a HEAD one unless HEAD requests are
+// left out, as one whose responses are kept and which may be answered from
+// the cache if the backends fail. HEAD and GET requests for a URL share the
+// key. The key tells apart the pools serving the request, A/B variants may
+// differ, and clients that take gzip as backends may answer them
+// differently. A trusted client's bypass header keeps the request from
+// being answered from the cache, its response is still kept.
+func (c *staleCache) withKey(r *http.Request) *http.Request {
+	if r.Method != http.MethodGet && (r.Method != http.MethodHead || c.head == headOff) {
+		return r
+	}
+	ctx := r.Context()
+	if bypass, _ := strconv.ParseBool(r.Header.Get(c.bypassHeader)); bypass && c.trusted.allows(r) {
+		ctx = context.WithValue(ctx, staleBypassCtx{}, true)
+	}
+	key := r.Host + r.URL.RequestURI()
+	if m := routeFrom(r.Context()); m != nil {
+		key += "|" + m.pool
+	}
+	if acceptsGzip(r.Header.Values("Accept-Encoding")) {
+		key += "|gzip"
+	}
+	return r.WithContext(context.WithValue(ctx, staleKeyCtx{}, key))
+}
+
+func staleKeyFrom(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(staleKeyCtx{}).(string)
+	return key, ok
+}
+
+// readKey returns the key the request may be answered from the cache
+// under, there is none if its responses aren't kept or it bypasses the cache
+func readKey(ctx context.Context) (string, bool) {
+	if bypass, _ := ctx.Value(staleBypassCtx{}).(bool); bypass {
+		return "", false
+	}
+	return staleKeyFrom(ctx)
+}
+
+// lookup returns the entry for the key if it may still be served to a
+// request with the given method, GET entries answer HEAD requests too
+func (c *staleCache) lookup(key, method string) *staleEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*staleEntry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	if e.head && method != http.MethodHead {
+		return nil
+	}
+	return e
+}
+
+// store keeps the entry in place of the one under its key, except that an
+// entry from a HEAD response doesn't replace a GET one, which answers
+// both methods
+func (c *staleCache) store(e *staleEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		if old := el.Value.(*staleEntry); e.head && !old.head && time.Now().Before(old.expires) {
+			return
+		}
+		c.order.Remove(el)
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*staleEntry).key)
+	}
+}
+
+// serve writes the stale response for the request if there is one and
+// reports whether it did
+func (c *staleCache) serve(w http.ResponseWriter, r *http.Request) bool {
+	key, ok := readKey(r.Context())
+	if !ok {
+		return false
+	}
+	e := c.lookup(key, r.Method)
+	if e == nil {
+		return false
+	}
+	h := w.Header()
+	for k, v := range e.header.Clone() {
+		h[k] = v
+	}
+	e.setStaleHeaders(h)
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+	return true
+}
+
+func (e *staleEntry) setStaleHeaders(h http.Header) {
+	h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	h.Add("Warning", staleWarning)
+}
+
+// handleResponse replaces a backend's server error with the stale
+// response if there is one, and keeps a copy of a cacheable response as
+// it is read
+func (c *staleCache) handleResponse(resp *http.Response) {
+	key, ok := staleKeyFrom(resp.Request.Context())
+	if !ok {
+		return
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if _, ok := readKey(resp.Request.Context()); !ok {
+			return
+		}
+		if e := c.lookup(key, resp.Request.Method); e != nil {
+			resp.Body.Close()
+			resp.StatusCode = e.status
+			resp.Status = ""
+			resp.Header = e.header.Clone()
+			e.setStaleHeaders(resp.Header)
+			resp.Body = http.NoBody
+			resp.ContentLength = 0
+			if !e.head {
+				// a HEAD gets the length of the GET body it doesn't get
+				resp.ContentLength = int64(len(e.body))
+				resp.Header.Set("Content-Length", strconv.Itoa(len(e.body)))
+			}
+			if resp.Request.Method != http.MethodHead {
+				resp.Body = io.NopCloser(bytes.NewReader(e.body))
+			}
+		}
+	case http.StatusOK:
+		head := resp.Request.Method == http.MethodHead
+		maxAge, keep := c.keepFor(resp.Request.Header, resp.Header)
+		if keep <= 0 || resp.Header.Get("Vary") != "" || !head && resp.ContentLength > c.maxBodyBytes {
+			return
+		}
+		e := &staleEntry{key: key, status: resp.StatusCode, header: resp.Header.Clone(), stored: time.Now(), head: head}
+		// cookies belong to the client they were set for, not to every
+		// client the entry is served to
+		e.header.Del("Set-Cookie")
+		e.freshUntil = e.stored.Add(maxAge)
+		e.expires = e.stored.Add(keep)
+		if head {
+			c.store(e)
+			return
+		}
+		resp.Body = &staleRecorder{src: resp.Body, cache: c, entry: e}
+	}
+}
+
+// keepFor returns how long a response is fresh and how long it may be
+// served from the cache going by its Cache-Control, 0 if it mustn't be
+// kept. Without a stale-if-error directive the configured max stale
+// applies. The cache is shared between clients, so as in a shared HTTP
+// cache responses setting cookies aren't kept, nor responses to requests
+// with credentials unless marked public, and s-maxage wins over max-age.
+// Responses without a Cache-Control are only kept if the config says so.
+func (c *staleCache) keepFor(req, h http.Header) (maxAge, keep time.Duration) {
+	if len(h.Values("Set-Cookie")) > 0 {
+		return 0, 0
+	}
+	if len(h.Values("Cache-Control")) == 0 && !c.storeImplicit {
+		return 0, 0
+	}
+	var staleIfError, sMaxAge time.Duration
+	hasStale, hasSMaxAge, public := false, false, false
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			secs, _ := strconv.Atoi(strings.Trim(value, `"`))
+			switch strings.ToLower(name) {
+			case "no-store", "private", "no-cache":
+				return 0, 0
+			case "public", "must-revalidate":
+				public = true
+			case "max-age":
+				maxAge = time.Duration(secs) * time.Second
+			case "s-maxage":
+				sMaxAge = time.Duration(secs) * time.Second
+				hasSMaxAge, public = true, true
+			case "stale-if-error":
+				staleIfError = time.Duration(secs) * time.Second
+				hasStale = true
+			}
+		}
+	}
+	if req.Get("Authorization") != "" && !public {
+		return 0, 0
+	}
+	if hasSMaxAge {
+		maxAge = sMaxAge
+	}
+	if !hasStale {
+		staleIfError = c.maxStale
+	}
+	if staleIfError <= 0 {
+		return 0, 0
+	}
+	return maxAge, maxAge + staleIfError
+}
+
+// staleRecorder copies a response body as it is read and stores it once
+// it was read in full, bodies over the size limit are not kept
+type staleRecorder struct {
+	src   io.ReadCloser
+	cache *staleCache
+	entry *staleEntry
+	buf   bytes.Buffer
+	over  bool
+}
+
+func (r *staleRecorder) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if !r.over {
+		if int64(r.buf.Len()+n) > r.cache.maxBodyBytes {
+			r.over = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !r.over {
+		r.entry.body = r.buf.Bytes()
+		r.cache.store(r.entry)
+		r.over = true
+	}
+	return n, err
+}
+
+func (r *staleRecorder) Close() error {
+	return r.src.Close()
+}
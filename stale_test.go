@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// staleBackend answers with the headers set by header until failing is
+// set, then with a 503
+func staleBackend(t *testing.T, failing *atomic.Bool, header func(w http.ResponseWriter, r *http.Request)) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		header(w, r)
+		w.Write([]byte("hello"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStaleCacheKeepsOnlySharedResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		header func(w http.ResponseWriter, r *http.Request)
+		auth   bool
+		kept   bool
+	}{
+		{"max-age", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=0")
+		}, false, true},
+		{"no cache control", func(w http.ResponseWriter, r *http.Request) {}, false, false},
+		{"private", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}, false, false},
+		{"set cookie", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("Set-Cookie", "session=secret")
+		}, false, false},
+		{"authorization", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=0")
+		}, true, false},
+		{"authorization public", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "public, max-age=0")
+		}, true, true},
+		{"authorization s-maxage", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "s-maxage=0")
+		}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing atomic.Bool
+			srv := staleBackend(t, &failing, tt.header)
+			lb := newTestLoadBalancer(t, []string{srv.URL}, func(cfg *Config) {
+				cfg.StaleIfError = &StaleIfErrorConfig{MaxStale: Duration{time.Minute}}
+			})
+			req := func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/page", nil)
+				if tt.auth {
+					r.Header.Set("Authorization", "Bearer token")
+				}
+				return r
+			}
+			if rec := do(lb, req()); rec.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", rec.Code)
+			}
+			failing.Store(true)
+			// another client, without the credentials
+			rec := do(lb, httptest.NewRequest(http.MethodGet, "/page", nil))
+			if kept := rec.Code == http.StatusOK; kept != tt.kept {
+				t.Fatalf("served from the cache: %v, want %v", kept, tt.kept)
+			}
+			if got := rec.Header().Values("Set-Cookie"); len(got) > 0 {
+				t.Fatalf("cached response sets cookies %q", got)
+			}
+		})
+	}
+}
+
+func TestStaleCacheStoresWithoutCacheControlWhenAsked(t *testing.T) {
+	var failing atomic.Bool
+	srv := staleBackend(t, &failing, func(w http.ResponseWriter, r *http.Request) {})
+	lb := newTestLoadBalancer(t, []string{srv.URL}, func(cfg *Config) {
+		cfg.StaleIfError = &StaleIfErrorConfig{MaxStale: Duration{time.Minute}, StoreWithoutCacheControl: true}
+	})
+	do(lb, httptest.NewRequest(http.MethodGet, "/page", nil))
+	failing.Store(true)
+	if rec := do(lb, httptest.NewRequest(http.MethodGet, "/page", nil)); rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("got %d %q, want the stale response", rec.Code, rec.Body)
+	}
+}
+
+func TestStaleCacheDoesNotKeepStickyCookie(t *testing.T) {
+	var failing atomic.Bool
+	srv := staleBackend(t, &failing, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+	})
+	lb := newTestLoadBalancer(t, []string{srv.URL}, func(cfg *Config) {
+		cfg.StaleIfError = &StaleIfErrorConfig{MaxStale: Duration{time.Minute}}
+		cfg.StickyCookie = &StickyCookieConfig{}
+	})
+	if rec := do(lb, httptest.NewRequest(http.MethodGet, "/page", nil)); rec.Header().Get("Set-Cookie") == "" {
+		t.Fatal("no sticky cookie set")
+	}
+	for _, el := range lb.stale.entries {
+		if c := el.Value.(*staleEntry).header.Values("Set-Cookie"); len(c) > 0 {
+			t.Fatalf("cache entry keeps cookies %q", c)
+		}
+	}
+	if len(lb.stale.entries) != 1 {
+		t.Fatalf("%d cache entries, want 1", len(lb.stale.entries))
+	}
+}
+
+func TestStaleCacheRelatesHeadAndGet(t *testing.T) {
+	type step struct {
+		method string
+		status int
+		body   string
+	}
+	tests := []struct {
+		name   string
+		head   string
+		maxAge string
+		before []string
+		after  []step
+	}{
+		{"get then head", headStale, "0", []string{http.MethodGet}, []step{
+			{http.MethodHead, http.StatusOK, ""},
+			{http.MethodGet, http.StatusOK, "hello"},
+		}},
+		{"head then get", headStale, "0", []string{http.MethodHead}, []step{
+			{http.MethodGet, http.StatusServiceUnavailable, ""},
+			{http.MethodHead, http.StatusOK, ""},
+		}},
+		{"head keeps a valid get", headStale, "60", []string{http.MethodGet, http.MethodHead}, []step{
+			{http.MethodGet, http.StatusOK, "hello"},
+		}},
+		{"off", headOff, "0", []string{http.MethodGet}, []step{
+			{http.MethodHead, http.StatusServiceUnavailable, ""},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing atomic.Bool
+			srv := staleBackend(t, &failing, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age="+tt.maxAge)
+			})
+			lb := newTestLoadBalancer(t, []string{srv.URL}, func(cfg *Config) {
+				cfg.StaleIfError = &StaleIfErrorConfig{MaxStale: Duration{time.Minute}, Head: tt.head}
+			})
+			for _, m := range tt.before {
+				if rec := do(lb, httptest.NewRequest(m, "/page", nil)); rec.Code != http.StatusOK {
+					t.Fatalf("%s: status %d, want 200", m, rec.Code)
+				}
+			}
+			failing.Store(true)
+			for _, s := range tt.after {
+				rec := do(lb, httptest.NewRequest(s.method, "/page", nil))
+				if rec.Code != s.status {
+					t.Fatalf("%s: status %d, want %d", s.method, rec.Code, s.status)
+				}
+				if s.status == http.StatusOK && rec.Body.String() != s.body {
+					t.Fatalf("%s: body %q, want %q", s.method, rec.Body, s.body)
+				}
+			}
+		})
+	}
+}
+
+func TestStaleCacheAnswersFreshHeadFromGet(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	lb := newTestLoadBalancer(t, []string{srv.URL}, func(cfg *Config) {
+		cfg.StaleIfError = &StaleIfErrorConfig{MaxStale: Duration{time.Minute}, Head: headFresh}
+	})
+	do(lb, httptest.NewRequest(http.MethodGet, "/page", nil))
+	rec := do(lb, httptest.NewRequest(http.MethodHead, "/page", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "5" {
+		t.Fatalf("got %d %q Content-Length %q, want the GET's headers without its body",
+			rec.Code, rec.Body, rec.Header().Get("Content-Length"))
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("backend asked %d times, want the HEAD answered from the cache", n)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// PoolState is the runtime changes made to the configured backends through
+// the admin API, it is kept across restarts and applied over the config.
+// Backends are keyed by their normalized address, scheme://host:port as
+// FindBackend compares them, so the config can spell a URL differently.
+type PoolState struct {
+	// Removed are the backends that were removed
+	Removed []string `json:"removed,omitempty"`
+	// Weights are the weights set, a weight of 0 is a drained backend
+	Weights map[string]int `json:"weights,omitempty"`
+	// Drained are the backends whose ramp-down was still running, they
+	// come back with a weight of 0
+	Drained []string `json:"drained,omitempty"`
+}
+
+// stateKey is the key of the backend at u in the pool state
+func stateKey(u *url.URL) string {
+	scheme, hostport := backendAddr(u)
+	return scheme + "://" + hostport
+}
+
+// normalizeKeys rekeys a state saved by raw URL
+func (s *PoolState) normalizeKeys() {
+	rekey := func(k string) string {
+		if u, err := url.Parse(k); err == nil && u.Host != "" {
+			return stateKey(u)
+		}
+		return k
+	}
+	for i, k := range s.Removed {
+		s.Removed[i] = rekey(k)
+	}
+	s.Removed = slices.Compact(slices.Sorted(slices.Values(s.Removed)))
+	for i, k := range s.Drained {
+		s.Drained[i] = rekey(k)
+	}
+	s.Drained = slices.Compact(slices.Sorted(slices.Values(s.Drained)))
+	if s.Weights != nil {
+		weights := make(map[string]int, len(s.Weights))
+		for k, w := range s.Weights {
+			weights[rekey(k)] = w
+		}
+		s.Weights = weights
+	}
+}
+
+// StateStore persists the pool state
+type StateStore interface {
+	Save(state PoolState) error
+	// Load returns an empty state if nothing was saved yet
+	Load() (PoolState, error)
+}
+
+// fileStateStore keeps the pool state in a JSON file
+type fileStateStore struct {
+	path string
+}
+
+func (s fileStateStore) Save(state PoolState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// written aside and renamed so a crash never leaves a torn file
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s fileStateStore) Load() (PoolState, error) {
+	var state PoolState
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("state %s: %w", s.path, err)
+	}
+	return state, nil
+}
+
+// poolState tracks the runtime changes and saves them to the store on every change
+type poolState struct {
+	store StateStore
+	mu    sync.Mutex
+	state PoolState
+}
+
+func loadPoolState(store StateStore) (*poolState, error) {
+	state, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	state.normalizeKeys()
+	return &poolState{store: store, state: state}, nil
+}
+
+func (ps *poolState) removed(u *url.URL) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return slices.Contains(ps.state.Removed, stateKey(u))
+}
+
+// weight returns the weight the backend at u starts with, 0 if it was
+// being drained
+func (ps *poolState) weight(u *url.URL) (int, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	k := stateKey(u)
+	if slices.Contains(ps.state.Drained, k) {
+		return 0, true
+	}
+	w, ok := ps.state.Weights[k]
+	return w, ok
+}
+
+// setWeight records the weight, it ends a drain
+func (ps *poolState) setWeight(u *url.URL, weight int) {
+	k := stateKey(u)
+	ps.update(func(s *PoolState) {
+		if s.Weights == nil {
+			s.Weights = make(map[string]int)
+		}
+		s.Weights[k] = weight
+		s.Drained = slices.DeleteFunc(s.Drained, func(d string) bool { return d == k })
+	})
+}
+
+func (ps *poolState) drain(u *url.URL) {
+	k := stateKey(u)
+	ps.update(func(s *PoolState) {
+		if !slices.Contains(s.Drained, k) {
+			s.Drained = append(s.Drained, k)
+		}
+	})
+}
+
+// add forgets the removal of a backend added back
+func (ps *poolState) add(u *url.URL) {
+	k := stateKey(u)
+	ps.update(func(s *PoolState) {
+		s.Removed = slices.DeleteFunc(s.Removed, func(r string) bool { return r == k })
+	})
+}
+
+func (ps *poolState) remove(u *url.URL) {
+	k := stateKey(u)
+	ps.update(func(s *PoolState) {
+		delete(s.Weights, k)
+		s.Drained = slices.DeleteFunc(s.Drained, func(d string) bool { return d == k })
+		if !slices.Contains(s.Removed, k) {
+			s.Removed = append(s.Removed, k)
+		}
+	})
+}
+
+// update changes the state and saves it, a failed save is logged and the
+// change kept in memory
+func (ps *poolState) update(change func(*PoolState)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	change(&ps.state)
+	state := PoolState{
+		Removed: slices.Clone(ps.state.Removed),
+		Weights: maps.Clone(ps.state.Weights),
+		Drained: slices.Clone(ps.state.Drained),
+	}
+	if err := ps.store.Save(state); err != nil {
+		fmt.Printf("saving pool state failed: %s\n", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPoolStateKeepsDrainAcrossRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	setup := func(cfg *Config) { cfg.StateFile = file }
+
+	lb := newTestLoadBalancer(t, []string{"http://a.example:8080", "http://b.example"}, setup)
+	if err := lb.DrainGracefully("http://a.example:8080", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	lb.Close()
+
+	// the restarted config spells the URLs differently
+	lb = newTestLoadBalancer(t, []string{"http://A.example:8080/", "http://b.example:80"}, setup)
+	for _, b := range lb.Backends() {
+		want := 1
+		if b.URL.Hostname() == "A.example" {
+			want = 0
+		}
+		if w := b.Weight(); w != want {
+			t.Errorf("%s weight %d, want %d", b.URL, w, want)
+		}
+	}
+
+	// setting the weight ends the drain
+	a := lb.Backends()[0]
+	lb.state.setWeight(a.URL, 3)
+	if w, _ := lb.state.weight(a.URL); w != 3 {
+		t.Errorf("weight %d after setting it, want 3", w)
+	}
+}
+
+func TestPoolStateRekeysRawURLs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	saved := `{"removed": ["http://B.example:80/"], "weights": {"https://a.example/api": 5}}`
+	if err := os.WriteFile(file, []byte(saved), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []string{"https://a.example:443", "http://b.example"}, func(cfg *Config) {
+		cfg.StateFile = file
+	})
+	backends := lb.Backends()
+	if len(backends) != 1 {
+		t.Fatalf("%d backends, want the removed one left out", len(backends))
+	}
+	if w := backends[0].Weight(); w != 5 {
+		t.Errorf("weight %d, want 5", w)
+	}
+}
+
+// memStateStore keeps the pool state in memory
+type memStateStore struct {
+	state PoolState
+	saves int
+}
+
+func (s *memStateStore) Save(state PoolState) error {
+	s.state = state
+	s.saves++
+	return nil
+}
+
+func (s *memStateStore) Load() (PoolState, error) {
+	return s.state, nil
+}
+
+func TestPoolStateCustomStore(t *testing.T) {
+	store := &memStateStore{state: PoolState{Weights: map[string]int{"http://a.example:80": 4}}}
+	lb := newTestLoadBalancer(t, []string{"http://a.example", "http://b.example"}, func(cfg *Config) {
+		cfg.StateStore = store
+		// the store wins over the file
+		cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	})
+	if w := lb.Backends()[0].Weight(); w != 4 {
+		t.Errorf("weight %d, want 4 from the store", w)
+	}
+
+	lb.state.remove(lb.Backends()[1].URL)
+	if store.saves != 1 || len(store.state.Removed) != 1 || store.state.Removed[0] != "http://b.example:80" {
+		t.Errorf("store has %+v after %d saves, want b removed", store.state, store.saves)
+	}
+	if _, err := os.Stat(lb.cfg.StateFile); !os.IsNotExist(err) {
+		t.Errorf("state file written with a store set: %v", err)
+	}
+}
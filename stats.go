@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Stats is a point in time view of the load balancer state
+type Stats struct {
+	// InFlight are the requests being served, Shed the ones answered with
+	// 503 because max_in_flight were already being served
+	InFlight int64          `json:"in_flight"`
+	Shed     uint64         `json:"shed"`
+	Backends []BackendStats `json:"backends"`
+	Routes   []RouteStats   `json:"routes"`
+	Pools    []PoolStats    `json:"pools"`
+	// RetryRatio are the retries per request over the retry budget's
+	// window, RetriesDenied the retries the spent budget refused
+	RetryRatio    float64 `json:"retry_ratio"`
+	RetriesDenied uint64  `json:"retries_denied"`
+	// DualWrites are the requests whose primary and secondary answers were
+	// compared, DualWriteMismatches those whose answers differed
+	DualWrites          uint64 `json:"dual_writes"`
+	DualWriteMismatches uint64 `json:"dual_write_mismatches"`
+}
+
+// PoolStats is a point in time view of a pool's health, Degraded is set
+// while fewer of its backends are alive than the degraded threshold asks for
+type PoolStats struct {
+	Name     string `json:"name"`
+	Backends int    `json:"backends"`
+	Alive    int    `json:"alive"`
+	Degraded bool   `json:"degraded"`
+}
+
+// RouteStats is a point in time view of the requests a route served,
+// requests no route matched are counted under the default route
+type RouteStats struct {
+	Name     string `json:"name"`
+	Requests uint64 `json:"requests"`
+	// Errors are the requests answered with a 5xx status
+	Errors  uint64   `json:"errors"`
+	Latency Duration `json:"latency"`
+}
+
+// BackendStats is a point in time view of a backend
+type BackendStats struct {
+	URL         string  `json:"url"`
+	Pool        string  `json:"pool,omitempty"`
+	Alive       bool    `json:"alive"`
+	Draining    bool    `json:"draining"`
+	FailingFast bool    `json:"failing_fast"`
+	ActiveConns int64   `json:"active_conns"`
+	ActiveCost  float64 `json:"active_cost"`
+	Requests    uint64  `json:"requests"`
+	Errors      uint64  `json:"errors"`
+	Load        float64 `json:"load"`
+	Weight      int     `json:"weight"`
+	// Breaker is the state of the fail-fast circuit breaker, empty if fail
+	// fast is disabled, BreakerForced set while an operator pins it.
+	// BreakerFailures are the failures in a row and BreakerTrips the times
+	// it tripped since it was last reset.
+	Breaker         string `json:"breaker,omitempty"`
+	BreakerForced   bool   `json:"breaker_forced,omitempty"`
+	BreakerFailures int    `json:"breaker_failures"`
+	BreakerTrips    uint64 `json:"breaker_trips"`
+	// RampDown is how long the backend's weight ramp-down has left
+	RampDown Duration `json:"ramp_down,omitzero"`
+	// ConnLimit is the lower of max_conns and the adaptive concurrency limit, 0 for none
+	ConnLimit int64 `json:"conn_limit"`
+	// Version is the version the backend reported to its health probes
+	Version string `json:"version,omitempty"`
+	// RequestShare is the share of the pool's requests the backend got in
+	// the last stats window, WeightShare the share its weight asks for
+	RequestShare float64 `json:"request_share"`
+	WeightShare  float64 `json:"weight_share"`
+	// Responses counts the backend's responses by status class, "2xx" to
+	// "5xx", 4xx are the clients' fault, 5xx the backend's
+	Responses map[string]uint64 `json:"responses"`
+	// ClientCancels are requests whose client left before the response
+	ClientCancels uint64 `json:"client_cancels"`
+	// Latency is the average response time
+	Latency Duration `json:"latency"`
+	// ProbeLatency is how long the last health probe took
+	ProbeLatency   Duration  `json:"probe_latency"`
+	LastTransition time.Time `json:"last_transition,omitzero"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// Stats returns the current state of every backend
+func (lb *LoadBalancer) Stats() Stats {
+	stats := Stats{InFlight: lb.inFlight.n.Load(), Shed: lb.inFlight.shed.Load()}
+	for _, b := range lb.Backends() {
+		stats.Backends = append(stats.Backends, b.stats())
+	}
+	for i, share := range weightShares(stats.Backends) {
+		stats.Backends[i].WeightShare = share
+	}
+	if lb.retryBudget != nil {
+		stats.RetryRatio = lb.retryBudget.currentRatio()
+		stats.RetriesDenied = lb.retryBudget.denied.Load()
+	}
+	if lb.dualWrite != nil {
+		stats.DualWrites = lb.dualWrite.compared.Load()
+		stats.DualWriteMismatches = lb.dualWrite.mismatched.Load()
+	}
+	stats.Routes = lb.routeStats.stats()
+	stats.Pools = lb.poolStats()
+	return stats
+}
+
+func (b *Backend) stats() BackendStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	s := BackendStats{
+		URL:            b.URL.String(),
+		Pool:           b.Pool,
+		Alive:          b.Alive,
+		Draining:       b.draining,
+		FailingFast:    b.FailingFast(),
+		ActiveConns:    b.activeConns.Load(),
+		ActiveCost:     b.ActiveCost(),
+		ConnLimit:      b.connLimit(),
+		RampDown:       Duration{b.rampRemaining()},
+		Requests:       b.requests.Load(),
+		Errors:         b.errors.Load(),
+		ClientCancels:  b.clientCancels.Load(),
+		Responses:      b.responseCounts(),
+		RequestShare:   b.requestShare,
+		Load:           b.load,
+		Weight:         b.weight,
+		Version:        b.version,
+		Latency:        Duration{b.latency},
+		ProbeLatency:   Duration{b.probeLatency},
+		LastTransition: b.lastTransition,
+		LastError:      b.lastError,
+	}
+	if b.failFast != nil {
+		s.Breaker, s.BreakerForced = b.failFast.state()
+		s.BreakerFailures, s.BreakerTrips = b.failFast.counts()
+	}
+	return s
+}
+
+func (b *Backend) responseCounts() map[string]uint64 {
+	counts := make(map[string]uint64, len(b.responses))
+	for i := range b.responses {
+		counts[statusClass(i+1)] = b.responses[i].Load()
+	}
+	return counts
+}
+
+func statusClass(class int) string {
+	return fmt.Sprintf("%dxx", class)
+}
+
+// backendMetric is a per backend metric family in the Prometheus output
+type backendMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(BackendStats) float64
+}
+
+var backendMetrics = []backendMetric{
+	{"lb_backend_up", "gauge", "Whether the backend passed its last health check.", func(s BackendStats) float64 {
+		if s.Alive {
+			return 1
+		}
+		return 0
+	}},
+	{"lb_backend_draining", "gauge", "Whether the backend is draining.", func(s BackendStats) float64 {
+		if s.Draining {
+			return 1
+		}
+		return 0
+	}},
+	{"lb_backend_failing_fast", "gauge", "Whether the backend is limited to probe requests after failing.", func(s BackendStats) float64 {
+		if s.FailingFast {
+			return 1
+		}
+		return 0
+	}},
+	{"lb_backend_active_connections", "gauge", "Requests the backend is serving.", func(s BackendStats) float64 {
+		return float64(s.ActiveConns)
+	}},
+	{"lb_backend_active_cost", "gauge", "Estimated cost of the requests the backend is serving.", func(s BackendStats) float64 {
+		return s.ActiveCost
+	}},
+	{"lb_backend_connection_limit", "gauge", "Requests the backend may serve at once, 0 for no limit.", func(s BackendStats) float64 {
+		return float64(s.ConnLimit)
+	}},
+	{"lb_backend_requests_total", "counter", "Requests sent to the backend.", func(s BackendStats) float64 {
+		return float64(s.Requests)
+	}},
+	{"lb_backend_errors_total", "counter", "Requests to the backend that failed.", func(s BackendStats) float64 {
+		return float64(s.Errors)
+	}},
+	{"lb_backend_client_cancelled_total", "counter", "Requests to the backend whose client left before the response.", func(s BackendStats) float64 {
+		return float64(s.ClientCancels)
+	}},
+	{"lb_backend_request_share", "gauge", "Share of the pool's requests the backend got in the last stats window.", func(s BackendStats) float64 {
+		return s.RequestShare
+	}},
+	{"lb_backend_weight_share", "gauge", "Share of the pool's weight the backend has.", func(s BackendStats) float64 {
+		return s.WeightShare
+	}},
+	{"lb_backend_load", "gauge", "Smoothed load reported by the backend.", func(s BackendStats) float64 {
+		return s.Load
+	}},
+	{"lb_backend_weight", "gauge", "Weight used by weighted strategies.", func(s BackendStats) float64 {
+		return float64(s.Weight)
+	}},
+	{"lb_backend_latency_seconds", "gauge", "Average response time.", func(s BackendStats) float64 {
+		return s.Latency.Seconds()
+	}},
+	{"lb_backend_health_check_duration_seconds", "gauge", "Duration of the last health probe.", func(s BackendStats) float64 {
+		return s.ProbeLatency.Seconds()
+	}},
+	{"lb_backend_last_transition_timestamp_seconds", "gauge", "Time the backend last changed health state.", func(s BackendStats) float64 {
+		if s.LastTransition.IsZero() {
+			return 0
+		}
+		return float64(s.LastTransition.UnixNano()) / 1e9
+	}},
+}
+
+// routeMetric is a per route metric family in the Prometheus output
+type routeMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(RouteStats) float64
+}
+
+var routeMetrics = []routeMetric{
+	{"lb_route_requests_total", "counter", "Requests the route served.", func(s RouteStats) float64 {
+		return float64(s.Requests)
+	}},
+	{"lb_route_errors_total", "counter", "Requests the route answered with a 5xx status.", func(s RouteStats) float64 {
+		return float64(s.Errors)
+	}},
+	{"lb_route_latency_seconds", "gauge", "Average response time.", func(s RouteStats) float64 {
+		return s.Latency.Seconds()
+	}},
+}
+
+// poolMetric is a per pool metric family in the Prometheus output
+type poolMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(PoolStats) float64
+}
+
+var poolMetrics = []poolMetric{
+	{"lb_pool_backends", "gauge", "Backends in the pool.", func(s PoolStats) float64 {
+		return float64(s.Backends)
+	}},
+	{"lb_pool_backends_alive", "gauge", "Backends in the pool that passed their last health check.", func(s PoolStats) float64 {
+		return float64(s.Alive)
+	}},
+	{"lb_pool_degraded", "gauge", "Whether fewer backends are alive than the degraded threshold asks for.", func(s PoolStats) float64 {
+		if s.Degraded {
+			return 1
+		}
+		return 0
+	}},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the stats in the Prometheus text format
+func writeMetrics(w io.Writer, stats Stats) {
+	fmt.Fprintf(w, "# HELP lb_in_flight_requests Requests being served.\n# TYPE lb_in_flight_requests gauge\nlb_in_flight_requests %d\n", stats.InFlight)
+	fmt.Fprintf(w, "# HELP lb_shed_requests_total Requests shed because max_in_flight were being served.\n# TYPE lb_shed_requests_total counter\nlb_shed_requests_total %d\n", stats.Shed)
+	fmt.Fprintf(w, "# HELP lb_retry_ratio Retries per request over the retry budget window.\n# TYPE lb_retry_ratio gauge\nlb_retry_ratio %g\n", stats.RetryRatio)
+	fmt.Fprintf(w, "# HELP lb_retries_denied_total Retries refused because the retry budget was spent.\n# TYPE lb_retries_denied_total counter\nlb_retries_denied_total %d\n", stats.RetriesDenied)
+	fmt.Fprintf(w, "# HELP lb_dual_writes_total Dual written requests whose answers were compared.\n# TYPE lb_dual_writes_total counter\nlb_dual_writes_total %d\n", stats.DualWrites)
+	fmt.Fprintf(w, "# HELP lb_dual_write_mismatches_total Dual written requests whose answers differed.\n# TYPE lb_dual_write_mismatches_total counter\nlb_dual_write_mismatches_total %d\n", stats.DualWriteMismatches)
+	for _, m := range backendMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, b := range stats.Backends {
+			fmt.Fprintf(w, "%s{backend=\"%s\",pool=\"%s\"} %g\n", m.name, labelEscaper.Replace(b.URL), labelEscaper.Replace(b.Pool), m.value(b))
+		}
+	}
+	fmt.Fprintf(w, "# HELP lb_backend_responses_total Responses from the backend by status class.\n# TYPE lb_backend_responses_total counter\n")
+	for _, b := range stats.Backends {
+		for class := 1; class <= 5; class++ {
+			fmt.Fprintf(w, "lb_backend_responses_total{backend=\"%s\",pool=\"%s\",code=\"%s\"} %d\n",
+				labelEscaper.Replace(b.URL), labelEscaper.Replace(b.Pool), statusClass(class), b.Responses[statusClass(class)])
+		}
+	}
+	for _, m := range poolMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, p := range stats.Pools {
+			fmt.Fprintf(w, "%s{pool=\"%s\"} %g\n", m.name, labelEscaper.Replace(p.Name), m.value(p))
+		}
+	}
+	for _, m := range routeMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, r := range stats.Routes {
+			fmt.Fprintf(w, "%s{route=\"%s\"} %g\n", m.name, labelEscaper.Replace(r.Name), m.value(r))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultStickyCookie is the cookie the backend of a sticky session is kept in
+const defaultStickyCookie = "lb_backend"
+
+// cookieAffinity keeps clients on the backend named in their cookie. New
+// sessions go to the inner strategy's pick unless that backend already
+// holds more than its weight's share of the sessions by the rebalance
+// factor, then they go to the backend furthest below its share, so a
+// backend added later catches up instead of sitting idle. Session counts
+// fade over the session lifetime so they follow the sessions still going
+// on rather than every session ever started.
+type cookieAffinity struct {
+	cfg   *StickyCookieConfig
+	inner Strategy
+
+	mu       sync.Mutex
+	ids      map[*Backend]string
+	sessions map[*Backend]float64
+	// decayed is when the session counts were last faded
+	decayed time.Time
+}
+
+func newCookieAffinity(cfg *StickyCookieConfig, inner Strategy) *cookieAffinity {
+	return &cookieAffinity{
+		cfg:      cfg,
+		inner:    inner,
+		ids:      make(map[*Backend]string),
+		sessions: make(map[*Backend]float64),
+	}
+}
+
+func (s *cookieAffinity) cookieName() string {
+	if s.cfg.Name != "" {
+		return s.cfg.Name
+	}
+	return defaultStickyCookie
+}
+
+// id is the cookie value for the backend, a hash so backend addresses aren't exposed
+func (s *cookieAffinity) id(b *Backend) string {
+	id, ok := s.ids[b]
+	if !ok {
+		id = strconv.FormatUint(hashKey(b.URL.String()), 36)
+		s.ids[b] = id
+	}
+	return id
+}
+
+func (s *cookieAffinity) Next(backends []*Backend, r *http.Request) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, err := r.Cookie(s.cookieName()); err == nil {
+		for _, b := range backends {
+			if s.id(b) == c.Value && b.Available() {
+				return b
+			}
+		}
+	}
+
+	b := s.inner.Next(backends, r)
+	if b == nil {
+		return nil
+	}
+	if s.cfg.Rebalance > 0 {
+		s.decay(time.Now())
+		if s.overShare(b, backends) {
+			b = s.leastLoaded(backends)
+		}
+	}
+	return b
+}
+
+// decay fades the session counts by the time since the last call, a
+// session counts for less the longer ago it started
+func (s *cookieAffinity) decay(now time.Time) {
+	if !s.decayed.IsZero() {
+		f := math.Exp(-now.Sub(s.decayed).Seconds() / s.cfg.SessionLifetime.Seconds())
+		for b := range s.sessions {
+			s.sessions[b] *= f
+		}
+	}
+	s.decayed = now
+}
+
+// prune forgets the backends that were removed
+func (s *cookieAffinity) prune(keep map[*Backend]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for b := range s.sessions {
+		if !keep[b] {
+			delete(s.sessions, b)
+		}
+	}
+	for b := range s.ids {
+		if !keep[b] {
+			delete(s.ids, b)
+		}
+	}
+}
+
+// overShare reports whether the backend holds more sessions than its
+// weight entitles it to by the rebalance factor
+func (s *cookieAffinity) overShare(b *Backend, backends []*Backend) bool {
+	sessions, weight := 0.0, 0
+	for _, o := range backends {
+		if o.Available() {
+			sessions += s.sessions[o]
+			weight += o.Weight()
+		}
+	}
+	if sessions == 0 || weight == 0 {
+		return false
+	}
+	share := s.sessions[b] / sessions
+	fair := float64(b.Weight()) / float64(weight)
+	return share > fair*s.cfg.Rebalance
+}
+
+// leastLoaded returns the available backend with the fewest sessions for its weight
+func (s *cookieAffinity) leastLoaded(backends []*Backend) *Backend {
+	var best *Backend
+	var bestRatio float64
+	for _, b := range backends {
+		if !b.Available() {
+			continue
+		}
+		ratio := s.sessions[b] / float64(b.Weight())
+		if best == nil || ratio < bestRatio {
+			best, bestRatio = b, ratio
+		}
+	}
+	return best
+}
+
+// setCookie points the client at the backend that answered, if its cookie
+// doesn't already. A session is counted here rather than in Next, which
+// may pick backends that turn out to be saturated.
+func (s *cookieAffinity) setCookie(b *Backend, resp *http.Response) {
+	s.mu.Lock()
+	id := s.id(b)
+	c, err := resp.Request.Cookie(s.cookieName())
+	issue := err != nil || c.Value != id
+	if issue {
+		s.sessions[b]++
+	}
+	s.mu.Unlock()
+	if !issue {
+		return
+	}
+	cookie := &http.Cookie{Name: s.cookieName(), Value: id, Path: "/", HttpOnly: true}
+	if s.cfg.MaxAge.Duration > 0 {
+		cookie.MaxAge = int(s.cfg.MaxAge.Seconds())
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
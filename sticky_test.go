@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStickySessionCountsFade(t *testing.T) {
+	lb := newTestLoadBalancer(t, []string{"http://a.test", "http://b.test"}, func(cfg *Config) {
+		cfg.StickyCookie = &StickyCookieConfig{Rebalance: 1.5, SessionLifetime: Duration{time.Minute}}
+	})
+	s := lb.stickyCookie
+	a, b := lb.Backends()[0], lb.Backends()[1]
+	now := time.Now()
+	s.decay(now)
+	s.sessions[a] = 100
+
+	// a long gone burst of sessions on a mustn't steer new ones away from it
+	s.decay(now.Add(10 * time.Minute))
+	if s.sessions[a] > 0.01 {
+		t.Fatalf("a still counts %.2f sessions after 10 lifetimes", s.sessions[a])
+	}
+	s.sessions[b] = 1
+	if s.overShare(a, lb.Backends()) {
+		t.Fatal("a over its share on faded sessions")
+	}
+
+	s.decay(now.Add(11 * time.Minute))
+	if got := s.sessions[b]; got < 0.3 || got > 0.4 {
+		t.Fatalf("b counts %.2f sessions a lifetime on, want about 1/e", got)
+	}
+}
+
+func TestStickyForgetsRemovedBackends(t *testing.T) {
+	lb := newTestLoadBalancer(t, []string{"http://a.test", "http://b.test"}, func(cfg *Config) {
+		cfg.StickyCookie = &StickyCookieConfig{Rebalance: 1.5}
+	})
+	removed := lb.Backends()[0]
+	lb.stickyCookie.setCookie(removed, &http.Response{
+		Header:  make(http.Header),
+		Request: httptest.NewRequest(http.MethodGet, "/", nil),
+	})
+	if err := lb.RemoveBackendGraceful(removed.URL.String(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lb.stickyCookie.sessions[removed]; ok {
+		t.Fatal("sessions of the removed backend kept")
+	}
+	if _, ok := lb.stickyCookie.ids[removed]; ok {
+		t.Fatal("cookie id of the removed backend kept")
+	}
+}
+
+// strategyFunc lets a function stand in for a strategy
+type strategyFunc func(backends []*Backend, r *http.Request) *Backend
+
+func (f strategyFunc) Next(backends []*Backend, r *http.Request) *Backend {
+	return f(backends, r)
+}
+
+func TestStickyCountsOnlyAcquiredSessions(t *testing.T) {
+	var urls []string
+	for range 2 {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+	lb := newTestLoadBalancer(t, urls, func(cfg *Config) {
+		cfg.StickyCookie = &StickyCookieConfig{}
+		cfg.Backends[0].MaxConns = 1
+	})
+	saturated, free := lb.Backends()[0], lb.Backends()[1]
+	if !saturated.acquire() {
+		t.Fatal("backend busy")
+	}
+	defer saturated.release()
+	// the first pick of every request is the saturated backend, the retry
+	// the one that takes it
+	picks := 0
+	lb.stickyCookie.inner = strategyFunc(func(backends []*Backend, r *http.Request) *Backend {
+		picks++
+		if picks%2 == 1 {
+			return saturated
+		}
+		return free
+	})
+
+	for range 4 {
+		rec := do(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Set-Cookie") == "" {
+			t.Fatalf("status %d, cookie %q, want a new session", rec.Code, rec.Header().Get("Set-Cookie"))
+		}
+	}
+	if n := lb.stickyCookie.sessions[saturated]; n != 0 {
+		t.Errorf("saturated backend credited with %.2f sessions", n)
+	}
+	if n := lb.stickyCookie.sessions[free]; n != 4 {
+		t.Errorf("backend that served credited with %.2f sessions, want 4", n)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// zoneLabel is the backend label holding the zone the backend runs in
+const zoneLabel = "zone"
+
+// Strategy picks a backend for the request out of the given backends,
+// it returns nil if none of them can take the request
+type Strategy interface {
+	Next(backends []*Backend, r *http.Request) *Backend
+}
+
+// StrategyOption configures the strategies newStrategy creates
+type StrategyOption func(*strategyOptions)
+
+type strategyOptions struct {
+	rand *rand.Rand
+}
+
+// WithRandSource makes the random strategies draw from src so their picks
+// can be reproduced, by default they use the randomly seeded global source
+func WithRandSource(src rand.Source) StrategyOption {
+	r := rand.New(&lockedSource{src: src})
+	return func(o *strategyOptions) {
+		o.rand = r
+	}
+}
+
+// lockedSource makes a source safe to share between strategies serving
+// requests concurrently
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+func newStrategy(name, hashKey string, opts ...StrategyOption) (Strategy, error) {
+	var o strategyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	switch name {
+	case "", "round-robin":
+		return &roundRobin{}, nil
+	case "least-connections":
+		return &leastConnections{}, nil
+	case "least-load":
+		return &leastLoad{rand: o.rand}, nil
+	case "ip-hash":
+		return &consistentHash{key: clientIP}, nil
+	case "consistent-hash":
+		key, err := newKeyFunc(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return &consistentHash{key: key}, nil
+	case "weighted-consistent-hash":
+		key, err := newKeyFunc(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return &consistentHash{key: key, rings: ringCache{weighted: true}}, nil
+	case "weighted-round-robin":
+		return newWeightedRoundRobin(), nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q", name)
+}
+
+// ChainStrategy tries its strategies in order and returns the first pick
+type ChainStrategy []Strategy
+
+func (c ChainStrategy) Next(backends []*Backend, r *http.Request) *Backend {
+	for _, s := range c {
+		if b := s.Next(backends, r); b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+func newChainStrategy(steps []StrategyStepConfig, opts ...StrategyOption) (ChainStrategy, error) {
+	chain := make(ChainStrategy, len(steps))
+	for i, step := range steps {
+		s, err := newStrategy(step.Strategy, step.HashKey, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("strategy_chain step %d: %w", i, err)
+		}
+		if step.Zone != "" {
+			s = &zoneOnly{zone: step.Zone, inner: s}
+		}
+		chain[i] = s
+	}
+	return chain, nil
+}
+
+// strategyPruners returns the strategies in s, the steps of a chain
+// included, that keep state per backend
+func strategyPruners(s Strategy) []pruner {
+	switch s := s.(type) {
+	case ChainStrategy:
+		var ps []pruner
+		for _, step := range s {
+			ps = append(ps, strategyPruners(step)...)
+		}
+		return ps
+	case *zoneOnly:
+		return strategyPruners(s.inner)
+	case pruner:
+		return []pruner{s}
+	}
+	return nil
+}
+
+// zoneOnly limits the inner strategy to the backends in the zone
+type zoneOnly struct {
+	zone  string
+	inner Strategy
+}
+
+func (s *zoneOnly) Next(backends []*Backend, r *http.Request) *Backend {
+	var local []*Backend
+	for _, b := range backends {
+		if b.Labels[zoneLabel] == s.zone {
+			local = append(local, b)
+		}
+	}
+	if len(local) == 0 {
+		return nil
+	}
+	return s.inner.Next(local, r)
+}
+
+// roundRobin cycles through the available backends, or spreads their cost
+// evenly when request costs are estimated
+type roundRobin struct {
+	current int
+	credits costCredits
+	mu      sync.Mutex
+}
+
+func (s *roundRobin) Next(backends []*Backend, r *http.Request) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cost, ok := requestCostFrom(r.Context()); ok {
+		if s.credits == nil {
+			s.credits = make(costCredits)
+		}
+		return s.credits.pick(backends, cost, func(b *Backend) float64 {
+			if !b.Available() {
+				return 0
+			}
+			return 1
+		})
+	}
+	nBackends := len(backends)
+	if nBackends == 0 {
+		return nil
+	}
+	next := (s.current + 1) % nBackends
+	for i := 0; i < nBackends; i++ {
+		idx := (next + i) % nBackends
+		if backends[idx].Available() {
+			s.current = idx
+			return backends[idx]
+		}
+	}
+	return nil
+}
+
+// prune forgets the backends that were removed
+func (s *roundRobin) prune(keep map[*Backend]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credits.prune(keep)
+}
+
+// weightedRoundRobin is nginx's smooth weighted round-robin, backends are
+// picked in proportion to their weight without sending them bursts. When
+// request costs are estimated it is the cost they get that follows the
+// weights rather than the number of requests.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current costCredits
+	// factor scales a backend's weight to correct drift found by the
+	// distribution audit, backends not in it use their weight as is
+	factor map[*Backend]float64
+}
+
+// weightScale leaves room for factors to adjust weights by fractions
+const weightScale = 100
+
+func newWeightedRoundRobin() *weightedRoundRobin {
+	return &weightedRoundRobin{current: make(costCredits), factor: make(map[*Backend]float64)}
+}
+
+// setFactor scales the backend's configured weight by f, kept within
+// [minFactor, maxFactor], it replaces the factor set before
+func (s *weightedRoundRobin) setFactor(b *Backend, f float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f = min(max(f, minFactor), maxFactor)
+	s.factor[b] = f
+	return f
+}
+
+// resetFactor gives the backend its configured weight back
+func (s *weightedRoundRobin) resetFactor(b *Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.factor, b)
+}
+
+// prune forgets the backends that were removed
+func (s *weightedRoundRobin) prune(keep map[*Backend]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.prune(keep)
+	for b := range s.factor {
+		if !keep[b] {
+			delete(s.factor, b)
+		}
+	}
+}
+
+const (
+	minFactor = 0.5
+	maxFactor = 2
+)
+
+func (s *weightedRoundRobin) Next(backends []*Backend, r *http.Request) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cost, ok := requestCostFrom(r.Context())
+	if !ok {
+		cost = 1
+	}
+	return s.current.pick(backends, cost, func(b *Backend) float64 {
+		w := b.Weight() * weightScale
+		if w <= 0 || !b.Available() {
+			return 0
+		}
+		if f, ok := s.factor[b]; ok {
+			w = max(int(float64(w)*f), 1)
+		}
+		if f := b.rampFactor(); f < 1 {
+			w = int(float64(w) * f)
+		}
+		return float64(w)
+	})
+}
+
+// leastConnections picks the available backend serving the fewest requests,
+// or the least estimated cost when request costs are estimated, ties are
+// broken by rotating the starting point
+type leastConnections struct {
+	start atomic.Uint64
+}
+
+func (s *leastConnections) Next(backends []*Backend, r *http.Request) *Backend {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+	load := func(b *Backend) float64 { return float64(b.ActiveConns()) }
+	if _, ok := requestCostFrom(r.Context()); ok {
+		load = (*Backend).ActiveCost
+	}
+	offset := int(s.start.Add(1) % uint64(n))
+	var best *Backend
+	for i := 0; i < n; i++ {
+		b := backends[(offset+i)%n]
+		if !b.Available() {
+			continue
+		}
+		if best == nil || load(b) < load(best) {
+			best = b
+		}
+	}
+	return best
+}
+
+// localityAware prefers available backends in the given zone and only spills
+// over to the other zones when the inner strategy can't pick a local one
+type localityAware struct {
+	zone  string
+	inner Strategy
+}
+
+func (s *localityAware) Next(backends []*Backend, r *http.Request) *Backend {
+	var local []*Backend
+	for _, b := range backends {
+		if b.Labels[zoneLabel] == s.zone && b.Available() {
+			local = append(local, b)
+		}
+	}
+	if len(local) > 0 {
+		if b := s.inner.Next(local, r); b != nil {
+			return b
+		}
+	}
+	return s.inner.Next(backends, r)
+}
+
+// leastLoad picks two random available backends and takes the one reporting
+// the lower load, which avoids herding onto a single idle backend
+type leastLoad struct {
+	// rand is the seeded source if one was given
+	rand *rand.Rand
+}
+
+// intn returns a random int in [0, n)
+func (s *leastLoad) intn(n int) int {
+	if s.rand == nil {
+		return rand.Intn(n)
+	}
+	return s.rand.Intn(n)
+}
+
+func (s *leastLoad) Next(backends []*Backend, _ *http.Request) *Backend {
+	var available []*Backend
+	for _, b := range backends {
+		if b.Available() {
+			available = append(available, b)
+		}
+	}
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	}
+	i := s.intn(len(available))
+	j := s.intn(len(available) - 1)
+	if j >= i {
+		j++
+	}
+	if available[j].Load() < available[i].Load() {
+		return available[j]
+	}
+	return available[i]
+}
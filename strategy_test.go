@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWeightedRoundRobinForgetsRemovedBackends(t *testing.T) {
+	urls := []string{"http://a.example", "http://b.example", "http://c.example"}
+	for name, setup := range map[string]func(*Config){
+		"strategy": func(cfg *Config) { cfg.Strategy = "weighted-round-robin" },
+		"chain": func(cfg *Config) {
+			cfg.StrategyChain = []StrategyStepConfig{{Strategy: "weighted-round-robin"}}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, urls, setup)
+			wrr := strategyPruners(lb.strategy)[0].(*weightedRoundRobin)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for range 10 {
+				lb.strategy.Next(lb.Backends(), r)
+			}
+			if err := lb.RemoveBackendGraceful("http://b.example", 0); err != nil {
+				t.Fatal(err)
+			}
+			if len(wrr.current) != 2 {
+				t.Errorf("credit kept for %d backends, want 2", len(wrr.current))
+			}
+		})
+	}
+}
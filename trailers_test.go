@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// trailerBackend answers with a chunked body followed by a declared
+// X-Checksum trailer and an undeclared Grpc-Status one, counting the
+// requests in hits
+func trailerBackend(t *testing.T, delay time.Duration, hits *atomic.Int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello "))
+		w.(http.Flusher).Flush()
+		time.Sleep(delay)
+		w.Write([]byte("world"))
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTrailersReachTheClient(t *testing.T) {
+	for name, setup := range map[string]func(*Config){
+		"plain":              nil,
+		"max response bytes": func(cfg *Config) { cfg.MaxResponseBytes = 1 << 20 },
+		"stale cache": func(cfg *Config) {
+			cfg.StaleIfError = &StaleIfErrorConfig{MaxStale: Duration{time.Minute}}
+		},
+		"rewrite": func(cfg *Config) {
+			cfg.Rewrite = &RewriteConfig{Rules: []RewriteRule{{From: "hello", To: "hello"}}}
+		},
+		"coalesce": func(cfg *Config) { cfg.Coalesce = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			var hits atomic.Int64
+			backend := trailerBackend(t, 50*time.Millisecond, &hits)
+			lb := newTestLoadBalancer(t, []string{backend.URL}, setup)
+			front := httptest.NewServer(lb)
+			defer front.Close()
+
+			// concurrent requests so coalescing shares one response
+			var wg sync.WaitGroup
+			for range 3 {
+				wg.Go(func() {
+					resp, err := http.Get(front.URL)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer resp.Body.Close()
+					body, _ := io.ReadAll(resp.Body)
+					if string(body) != "hello world" {
+						t.Errorf("body %q", body)
+					}
+					if v := resp.Header.Get("X-Checksum"); v != "" {
+						t.Errorf("trailer sent as a header too: X-Checksum %q", v)
+					}
+					if v := resp.Trailer.Get("X-Checksum"); v != "abc123" {
+						t.Errorf("X-Checksum trailer %q, want abc123", v)
+					}
+					if v := resp.Trailer.Get("Grpc-Status"); v != "0" {
+						t.Errorf("Grpc-Status trailer %q, want 0", v)
+					}
+				})
+			}
+			wg.Wait()
+			if name == "coalesce" && hits.Load() == 3 {
+				t.Errorf("no request was coalesced")
+			}
+		})
+	}
+}
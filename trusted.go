@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+)
+
+// defaultTrustedCIDRs are the client networks trusted when none are configured
+var defaultTrustedCIDRs = []string{"127.0.0.0/8", "::1/128"}
+
+// trustedNets are the client networks allowed to steer the load balancer
+// with debug headers
+type trustedNets []netip.Prefix
+
+// newTrustedNets parses the CIDRs, loopback is trusted if there are none
+func newTrustedNets(cidrs []string) (trustedNets, error) {
+	if len(cidrs) == 0 {
+		cidrs = defaultTrustedCIDRs
+	}
+	var nets trustedNets
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, p)
+	}
+	return nets, nil
+}
+
+// allows reports whether the request came from a trusted network
+func (t trustedNets) allows(r *http.Request) bool {
+	ip, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range t {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
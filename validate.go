@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// reachabilityTimeout bounds each step of checking a backend is reachable
+const reachabilityTimeout = 5 * time.Second
+
+// Reachability is what checking a backend found, each step is only tried
+// if the one before succeeded
+type Reachability struct {
+	URL string `json:"url"`
+	// DNS is whether the host resolved, TCP whether it took a connection
+	// and HTTP whether it answered a request, with any status
+	DNS  bool `json:"dns"`
+	TCP  bool `json:"tcp"`
+	HTTP bool `json:"http"`
+	// Healthy is whether the backend passed its health check
+	Healthy bool `json:"healthy"`
+	// Latency is how long the backend took to answer the request
+	Latency Duration `json:"latency"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Reachable reports whether the backend passed every step
+func (r Reachability) Reachable() bool {
+	return r.DNS && r.TCP && r.HTTP && r.Healthy
+}
+
+// CheckReachability sends a request to every backend and probes it the
+// way the health check does, it is meant to catch a misconfiguration
+// before going live. The probes' raw outcomes are reported, with no
+// fail-open, and the backends' state is left alone.
+func (lb *LoadBalancer) CheckReachability(ctx context.Context) []Reachability {
+	backends := lb.Backends()
+	results := make([]Reachability, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := lb.reach(ctx, b)
+			if p := b.probe(ctx); p.err != nil {
+				if res.Error == "" {
+					res.Error = "health check: " + p.err.Error()
+				}
+			} else {
+				res.Healthy = true
+			}
+			results[i] = res
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (lb *LoadBalancer) reach(ctx context.Context, b *Backend) Reachability {
+	res := Reachability{URL: b.URL.String()}
+	fail := func(step string, err error) Reachability {
+		res.Error = fmt.Sprintf("%s: %s", step, err)
+		return res
+	}
+
+	stepCtx, cancel := context.WithTimeout(ctx, reachabilityTimeout)
+	defer cancel()
+	if net.ParseIP(b.URL.Hostname()) == nil {
+		if _, err := net.DefaultResolver.LookupHost(stepCtx, b.URL.Hostname()); err != nil {
+			return fail("dns", err)
+		}
+	}
+	res.DNS = true
+
+	stepCtx, cancel = context.WithTimeout(ctx, reachabilityTimeout)
+	defer cancel()
+	_, hostport := backendAddr(b.URL)
+	conn, err := newDialer(lb.cfg, reachabilityTimeout).DialContext(stepCtx, "tcp", hostport)
+	if err != nil {
+		return fail("tcp", err)
+	}
+	conn.Close()
+	res.TCP = true
+
+	stepCtx, cancel = context.WithTimeout(ctx, reachabilityTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(stepCtx, http.MethodGet, b.URL.String(), nil)
+	if err != nil {
+		return fail("http", err)
+	}
+	start := time.Now()
+	resp, err := b.ReverseProxy.Transport.RoundTrip(req)
+	if err != nil {
+		return fail("http", err)
+	}
+	resp.Body.Close()
+	res.Latency = Duration{time.Since(start)}
+	res.HTTP = true
+	return res
+}
+
+// writeReachability writes the results as a table and reports whether
+// every backend was reachable
+func writeReachability(w io.Writer, results []Reachability) bool {
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKEND\tDNS\tTCP\tHTTP\tHEALTHY\tLATENCY\tERROR")
+	yesNo := func(b bool) string {
+		if b {
+			return "ok"
+		}
+		return "FAIL"
+	}
+	for _, r := range results {
+		ok = ok && r.Reachable()
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.URL, yesNo(r.DNS), yesNo(r.TCP), yesNo(r.HTTP), yesNo(r.Healthy), r.Latency, r.Error)
+	}
+	tw.Flush()
+	return ok
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckReachabilityReportsRawProbes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	lb := newTestLoadBalancer(t, []string{srv.URL}, func(cfg *Config) {
+		cfg.HealthChecks = []ProbeConfig{{Type: "http"}}
+		cfg.HealthCheckFailOpen = true
+	})
+	var events []Event
+	lb.OnEvent(func(e Event) { events = append(events, e) })
+
+	results := lb.CheckReachability(context.Background())
+	for _, r := range results {
+		if !r.DNS || !r.TCP || !r.HTTP {
+			t.Fatalf("%+v, want reachable", r)
+		}
+		if r.Healthy || r.Error == "" {
+			t.Fatalf("%+v, want the failed probe reported despite fail-open", r)
+		}
+	}
+	for _, b := range lb.Backends() {
+		if !b.IsAlive() {
+			t.Fatalf("%s marked dead by the reachability check", b.URL)
+		}
+	}
+	if len(events) > 0 {
+		t.Fatalf("events %v, want none", events)
+	}
+}
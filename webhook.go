@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// webhookRetryDelay is the wait before the first redelivery, it doubles
+// with every further one
+const webhookRetryDelay = time.Second
+
+// WebhookNotifier POSTs events as JSON to a webhook. Events are queued and
+// delivered in the background so a slow webhook never holds up requests
+// or health checks, they are dropped when the queue is full. With a secret
+// the body is signed with HMAC-SHA256 in the X-Signature-256 header as
+// "sha256=<hex>".
+type WebhookNotifier struct {
+	url        string
+	secret     []byte
+	maxRetries int
+	client     *http.Client
+	queue      chan Event
+	dropped    atomic.Uint64
+}
+
+// NewWebhookNotifier creates a notifier for the webhook, Run delivers its events
+func NewWebhookNotifier(cfg *WebhookConfig) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:        cfg.URL,
+		secret:     []byte(cfg.Secret),
+		maxRetries: cfg.MaxRetries,
+		client:     &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone(), Timeout: cfg.Timeout.Duration},
+		queue:      make(chan Event, cfg.QueueSize),
+	}
+}
+
+// Notify queues the event for delivery, it never blocks
+func (n *WebhookNotifier) Notify(e Event) {
+	select {
+	case n.queue <- e:
+	default:
+		if n.dropped.Add(1) == 1 {
+			fmt.Printf("webhook queue full, dropping events\n")
+		}
+	}
+}
+
+// Run delivers the queued events until ctx is done
+func (n *WebhookNotifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-n.queue:
+			n.deliver(ctx, e)
+		}
+	}
+}
+
+// deliver sends the event, retrying failed attempts with backoff
+func (n *WebhookNotifier) deliver(ctx context.Context, e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := n.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if attempt >= n.maxRetries {
+			fmt.Printf("webhook: giving up on %s event: %s\n", e.Type, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (n *WebhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}